@@ -0,0 +1,325 @@
+// admin.go
+
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// maxNoticeLength caps a server-wide notice, in bytes.
+const maxNoticeLength = 1000
+
+// LiveHub is a running hub as shown on the admin console.
+type LiveHub struct {
+	RoomID  string
+	Clients int64 // Connected clients, counting each of a user's tabs
+}
+
+// AdminSession is a session as shown on the admin console. Tokens aren't
+// shown, since they would let an admin act as the session's user.
+type AdminSession struct {
+	ID       string // Stands in for the token in revoke requests
+	Username string
+	Created  string // In timestampFormat, empty if unknown
+}
+
+// sessionID returns the public identifier of a session token.
+func sessionID(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:8])
+}
+
+// csrfToken returns the token that a session's forms carry, proving a POST
+// came from one of our pages rather than another site. It is derived from
+// the session token, so it needs no storage and changes with every login.
+func csrfToken(sessionToken string) string {
+	mac := hmac.New(sha256.New, []byte(sessionToken))
+	mac.Write([]byte("csrf"))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// checkCSRF checks the csrf form field of a POST against the user's session.
+// It writes an error response and returns false otherwise.
+func checkCSRF(w http.ResponseWriter, r *http.Request, user *User) bool {
+	if r.Method != http.MethodPost {
+		return true
+	}
+	if !hmac.Equal([]byte(r.PostFormValue("csrf")), []byte(csrfToken(user.SessionToken))) {
+		http.Error(w, "The form has expired, reload the page and try again", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// authorizeAdmin checks that the session user is an admin and, for a POST,
+// that it came from our own form. It writes an error response and returns nil otherwise.
+func authorizeAdmin(rm *RoomManager, w http.ResponseWriter, r *http.Request) *User {
+	user := getUserFromSession(rm, r)
+	if user == nil {
+		http.Error(w, "Login required", http.StatusUnauthorized)
+		return nil
+	}
+	if !user.IsAdmin {
+		http.Error(w, "Only an admin can do that", http.StatusForbidden)
+		return nil
+	}
+	if !checkCSRF(w, r, user) {
+		return nil
+	}
+	return user
+}
+
+// hubs returns the running hubs.
+func (rm *RoomManager) hubs() []*Hub {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	hubs := make([]*Hub, 0, len(rm.Rooms))
+	for _, hub := range rm.Rooms {
+		hubs = append(hubs, hub)
+	}
+	return hubs
+}
+
+// liveHubs lists the running hubs by room ID.
+func (rm *RoomManager) liveHubs() []LiveHub {
+	var live []LiveHub
+	for _, hub := range rm.hubs() {
+		live = append(live, LiveHub{RoomID: hub.roomID, Clients: hub.clients.Load()})
+	}
+	slices.SortFunc(live, func(a, b LiveHub) int { return strings.Compare(a.RoomID, b.RoomID) })
+	return live
+}
+
+// kick disconnects the clients match selects from every running hub.
+func (rm *RoomManager) kick(match func(*Client) bool, reason string) {
+	for _, hub := range rm.hubs() {
+		hub.kick(match, reason)
+	}
+}
+
+// announceAll sends a notice to every running hub and returns how many
+// there were.
+func (rm *RoomManager) announceAll(message Message) int {
+	hubs := rm.hubs()
+	for _, hub := range hubs {
+		hub.announce(message)
+	}
+	return len(hubs)
+}
+
+// setArchived archives or unarchives a room and tells anyone in it.
+func (rm *RoomManager) setArchived(ctx context.Context, roomID string, archived bool) error {
+	if err := rm.db.SetRoomArchived(ctx, roomID, archived); err != nil {
+		return err
+	}
+
+	rm.mu.Lock()
+	hub := rm.Rooms[roomID]
+	rm.mu.Unlock()
+	if hub != nil {
+		hub.archived.Store(archived)
+		if archived {
+			hub.announce(Message{Type: "archived", Content: "This room has been archived"})
+		} else {
+			hub.announce(Message{Type: "unarchived", Content: "This room is open again"})
+		}
+	}
+	return nil
+}
+
+// setUserDisabled disables or re-enables a user. Disabling also logs them
+// out everywhere and disconnects them from every room.
+func (rm *RoomManager) setUserDisabled(ctx context.Context, username string, disabled bool) error {
+	if err := rm.db.SetUserDisabled(ctx, username, disabled); err != nil {
+		return err
+	}
+	if !disabled {
+		return nil
+	}
+	if err := rm.db.DeleteUserSessions(ctx, username); err != nil {
+		return err
+	}
+
+	rm.kick(func(c *Client) bool { return c.user.Username == username }, "This account has been disabled")
+	return nil
+}
+
+// revokeSession logs a session out and disconnects the clients using it.
+func (rm *RoomManager) revokeSession(ctx context.Context, token string) error {
+	if err := rm.db.DeleteSession(ctx, token); err != nil {
+		return err
+	}
+
+	rm.kick(func(c *Client) bool { return c.user.SessionToken == token }, "Your session has been revoked")
+	return nil
+}
+
+//
+// Serves the admin console
+//
+func serveAdmin(rm *RoomManager, w http.ResponseWriter, r *http.Request) {
+	user := authorizeAdmin(rm, w, r)
+	if user == nil {
+		return
+	}
+
+	type TemplateData struct {
+		Username string
+		CSRF     string
+		Users    []User
+		Sessions []AdminSession
+		Rooms    []Room
+		Hubs     []LiveHub
+		Backups  bool
+	}
+	data := TemplateData{Username: user.Username, CSRF: csrfToken(user.SessionToken), Hubs: rm.liveHubs(), Backups: rm.backups != nil}
+
+	var err error
+	if data.Users, err = rm.db.ListUsers(r.Context()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sessions, err := rm.db.ListSessions(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, session := range sessions {
+		s := AdminSession{ID: sessionID(session.Token), Username: session.Username}
+		if !session.CreatedAt.IsZero() {
+			s.Created = formatTimestamp(session.CreatedAt)
+		}
+		data.Sessions = append(data.Sessions, s)
+	}
+	if data.Rooms, err = rm.db.ListRooms(r.Context()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	if err := rm.pages.render(w, http.StatusOK, "admin.html", data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+//
+// Disables or re-enables a user
+//
+func serveAdminUser(rm *RoomManager, w http.ResponseWriter, r *http.Request, disabled bool) {
+	admin := authorizeAdmin(rm, w, r)
+	if admin == nil {
+		return
+	}
+
+	username := r.PathValue("username")
+	user, err := rm.db.GetUser(r.Context(), username)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if user == nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if disabled && username == admin.Username {
+		http.Error(w, "You can't disable your own account", http.StatusBadRequest)
+		return
+	}
+
+	if err := rm.setUserDisabled(r.Context(), username, disabled); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	loggerFrom(r.Context()).Info("Set user disabled", "admin", admin.Username, "target", username, "disabled", disabled)
+
+	http.Redirect(w, r, "/admin", http.StatusSeeOther)
+}
+
+//
+// Revokes a session, found by its ID on the admin console
+//
+func serveAdminRevoke(rm *RoomManager, w http.ResponseWriter, r *http.Request) {
+	admin := authorizeAdmin(rm, w, r)
+	if admin == nil {
+		return
+	}
+
+	sessions, err := rm.db.ListSessions(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	i := slices.IndexFunc(sessions, func(s Session) bool { return sessionID(s.Token) == r.PathValue("session") })
+	if i < 0 {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	if err := rm.revokeSession(r.Context(), sessions[i].Token); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	loggerFrom(r.Context()).Info("Revoked session", "admin", admin.Username, "target", sessions[i].Username)
+
+	http.Redirect(w, r, "/admin", http.StatusSeeOther)
+}
+
+//
+// Archives or unarchives a room from the admin console
+//
+func serveAdminArchive(rm *RoomManager, w http.ResponseWriter, r *http.Request, archived bool) {
+	admin := authorizeAdmin(rm, w, r)
+	if admin == nil {
+		return
+	}
+
+	room, err := rm.db.GetRoom(r.Context(), r.PathValue("chatRoom"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if room == nil {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return
+	}
+
+	if err := rm.setArchived(r.Context(), room.ID, archived); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/admin", http.StatusSeeOther)
+}
+
+//
+// Broadcasts a notice to every room with a running hub
+//
+func serveAdminNotice(rm *RoomManager, w http.ResponseWriter, r *http.Request) {
+	admin := authorizeAdmin(rm, w, r)
+	if admin == nil {
+		return
+	}
+
+	text := strings.TrimSpace(r.FormValue("notice"))
+	if text == "" {
+		http.Error(w, "The notice is empty", http.StatusBadRequest)
+		return
+	}
+	if len(text) > maxNoticeLength {
+		http.Error(w, "The notice is too long", http.StatusBadRequest)
+		return
+	}
+
+	rooms := rm.announceAll(Message{Type: "notice", Content: text, Timestamp: formatTimestamp(time.Now())})
+	loggerFrom(r.Context()).Info("Broadcast notice", "admin", admin.Username, "rooms", rooms)
+
+	http.Redirect(w, r, "/admin", http.StatusSeeOther)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// formRequest builds a request from the session's user. A POST carries the
+// session's form token unless form sets its own.
+func formRequest(method, path, token string, form url.Values) *http.Request {
+	if method == "POST" && !form.Has("csrf") {
+		form = maps.Clone(form)
+		if form == nil {
+			form = url.Values{}
+		}
+		form.Set("csrf", csrfToken(token))
+	}
+	r := httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.AddCookie(&http.Cookie{Name: "SessionToken", Value: token})
+	return r
+}
+
+// adminRequest runs an admin handler as the session's user.
+func adminRequest(rm *RoomManager, serve func(*RoomManager, http.ResponseWriter, *http.Request), method, path, token string, form url.Values) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	serve(rm, w, formRequest(method, path, token, form))
+	return w
+}
+
+func TestAdminConsole(t *testing.T) {
+	ctx := context.Background()
+	hub, store := startTestHub(t)
+	store.SetAdmin(ctx, "alice", true)
+	store.CreateSession(ctx, "alice-token", "alice")
+	store.CreateSession(ctx, "bob-token", "bob")
+
+	pages, err := NewPages(false, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rm := &RoomManager{
+		Rooms: map[string]*Hub{"lobby": hub},
+		db:    store,
+		pages: pages,
+	}
+
+	if w := adminRequest(rm, serveAdmin, "GET", "/admin", "bob-token", nil); w.Code != http.StatusForbidden {
+		t.Errorf("console for a non-admin: %d", w.Code)
+	}
+	w := adminRequest(rm, serveAdmin, "GET", "/admin", "alice-token", nil)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "/admin/users/bob/disable") {
+		t.Fatalf("console: %d %q", w.Code, w.Body.String())
+	}
+	if strings.Contains(w.Body.String(), "bob-token") {
+		t.Error("console shows session tokens")
+	}
+	if !strings.Contains(w.Body.String(), csrfToken("alice-token")) {
+		t.Error("console forms don't carry the form token")
+	}
+
+	alice := joinTestHub(hub, "alice", 16)
+	expectMessage(t, alice, "join", "alice")
+
+	// Posts from other sites lack the session's form token.
+	for _, form := range []url.Values{{"notice": {"Forged"}, "csrf": {""}}, {"notice": {"Forged"}, "csrf": {csrfToken("bob-token")}}} {
+		if w := adminRequest(rm, serveAdminNotice, "POST", "/admin/notice", "alice-token", form); w.Code != http.StatusForbidden {
+			t.Errorf("notice with form token %q: %d", form.Get("csrf"), w.Code)
+		}
+	}
+
+	// A notice reaches everyone in every room.
+	w = adminRequest(rm, serveAdminNotice, "POST", "/admin/notice", "alice-token", url.Values{"notice": {"Restarting at noon"}})
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("notice: %d %q", w.Code, w.Body.String())
+	}
+	if m := expectMessage(t, alice, "notice", ""); m.Content != "Restarting at noon" {
+		t.Errorf("notice content %q", m.Content)
+	}
+
+	// Revoking bob's session disconnects the clients using it.
+	bob := &Client{hub: hub, send: make(chan Message, 16), user: &User{Username: "bob", SessionToken: "bob-token"}, log: slog.Default(), ctx: ctx}
+	hub.register <- bob
+	expectMessage(t, bob, "join", "alice") // History
+	expectMessage(t, bob, "join", "bob")
+	expectMessage(t, alice, "join", "bob")
+	r := formRequest("POST", "/admin/sessions/x/revoke", "alice-token", nil)
+	r.SetPathValue("session", sessionID("bob-token"))
+	w = httptest.NewRecorder()
+	serveAdminRevoke(rm, w, r)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("revoke: %d %q", w.Code, w.Body.String())
+	}
+	expectMessage(t, alice, "leave", "bob")
+	if user, _ := store.GetUserFromSession(ctx, "bob-token"); user != nil {
+		t.Error("revoked session still logs in")
+	}
+
+	// Disabling bob logs out his other sessions and keeps him out.
+	store.CreateSession(ctx, "bob-token-2", "bob")
+	r = formRequest("POST", "/admin/users/bob/disable", "alice-token", nil)
+	r.SetPathValue("username", "bob")
+	w = httptest.NewRecorder()
+	serveAdminUser(rm, w, r, true)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("disable: %d %q", w.Code, w.Body.String())
+	}
+	if user, _ := store.GetUserFromSession(ctx, "bob-token-2"); user != nil {
+		t.Error("disabled user's session still logs in")
+	}
+	if user, _ := store.GetUser(ctx, "bob"); user == nil || !user.Disabled {
+		t.Errorf("bob after disabling: %+v", user)
+	}
+
+	// Admins can't lock themselves out.
+	r = formRequest("POST", "/admin/users/alice/disable", "alice-token", nil)
+	r.SetPathValue("username", "alice")
+	w = httptest.NewRecorder()
+	serveAdminUser(rm, w, r, true)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("disabling yourself: %d", w.Code)
+	}
+}
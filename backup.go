@@ -0,0 +1,349 @@
+// backup.go
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// backupTimeFormat stamps backup file names so they sort by age.
+const backupTimeFormat = "20060102T150405.000Z"
+
+// Backup writes a consistent copy of the database to path, which must not
+// exist. VACUUM INTO reads a single snapshot, so the server keeps writing
+// while it runs; it goes through the reader pool to stay off the writer.
+func (db *DB) Backup(ctx context.Context, path string) error {
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("error backing up database: %s already exists", path)
+	}
+
+	// Write under a temporary name so a partial copy is never mistaken for a backup.
+	tmp := path + ".tmp"
+	os.Remove(tmp)
+	if _, err := db.reader.ExecContext(ctx, "VACUUM INTO ?", tmp); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("error backing up database: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("error backing up database: %w", err)
+	}
+	return nil
+}
+
+// Backups writes timestamped backups into a directory and deletes all but
+// the newest keep of them.
+type Backups struct {
+	db     Backuper
+	dir    string
+	prefix string // File names are prefix-TIME.db
+	keep   int    // 0 keeps every backup
+	mu     sync.Mutex
+	last   time.Time     // Stamp of the latest backup, guarded by mu
+	stop   chan struct{} // Set by start
+	done   chan struct{}
+}
+
+// NewBackups returns backups of db named after the database file dbPath.
+func NewBackups(db Backuper, dbPath, dir string, keep int) *Backups {
+	return &Backups{
+		db:     db,
+		dir:    dir,
+		prefix: strings.TrimSuffix(filepath.Base(dbPath), filepath.Ext(dbPath)) + "-",
+		keep:   keep,
+	}
+}
+
+// Create takes a backup, rotates old ones out and returns the new file's path.
+func (b *Backups) Create(ctx context.Context) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err := os.MkdirAll(b.dir, 0o755); err != nil {
+		return "", fmt.Errorf("error creating backup directory: %w", err)
+	}
+	// Backups taken within the same millisecond get successive stamps.
+	stamp := time.Now().UTC().Truncate(time.Millisecond)
+	if !stamp.After(b.last) {
+		stamp = b.last.Add(time.Millisecond)
+	}
+	b.last = stamp
+	path := filepath.Join(b.dir, b.prefix+stamp.Format(backupTimeFormat)+".db")
+	if err := b.db.Backup(ctx, path); err != nil {
+		return "", err
+	}
+	return path, b.rotate()
+}
+
+// rotate deletes the oldest backups beyond keep.
+func (b *Backups) rotate() error {
+	if b.keep <= 0 {
+		return nil
+	}
+	paths, err := filepath.Glob(filepath.Join(b.dir, b.prefix+"*.db"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(paths)
+	for len(paths) > b.keep {
+		if err := os.Remove(paths[0]); err != nil {
+			return fmt.Errorf("error rotating backups: %w", err)
+		}
+		paths = paths[1:]
+	}
+	return nil
+}
+
+// start takes a backup every interval until Close.
+func (b *Backups) start(interval time.Duration) {
+	b.stop = make(chan struct{})
+	b.done = make(chan struct{})
+	go func() {
+		defer close(b.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if path, err := b.Create(context.Background()); err != nil {
+					slog.Error("Scheduled backup failed", "err", err)
+				} else {
+					slog.Info("Backed up database", "path", path)
+				}
+			case <-b.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Close stops scheduled backups, waiting for one in progress.
+func (b *Backups) Close() {
+	if b.stop != nil {
+		close(b.stop)
+		<-b.done
+	}
+}
+
+//
+// Takes a backup on demand. Admins only.
+//
+func serveBackup(rm *RoomManager, w http.ResponseWriter, r *http.Request) {
+	user := getUserFromSession(rm, r)
+	if user == nil || !user.IsAdmin {
+		http.Error(w, "Only an admin can take backups", http.StatusForbidden)
+		return
+	}
+	if !checkCSRF(w, r, user) {
+		return
+	}
+	if rm.backups == nil {
+		http.Error(w, "This database doesn't support online backups", http.StatusNotImplemented)
+		return
+	}
+
+	path, err := rm.backups.Create(r.Context())
+	if err != nil {
+		loggerFrom(r.Context()).Error("Backup failed", "err", err)
+		http.Error(w, "Backup failed", http.StatusInternalServerError)
+		return
+	}
+	loggerFrom(r.Context()).Info("Backed up database", "path", path)
+	fmt.Fprintln(w, path)
+}
+
+// runBackup implements the backup command. It is safe to run while the
+// server is using the database.
+func runBackup(args []string) error {
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	output := flags.String("o", "", "write the backup to this file instead of a timestamped file in -backup-dir")
+	c, err := parseCommand(flags, "", args, 0)
+	if err != nil {
+		return err
+	}
+
+	store, err := dialStore(c.DB)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	db, ok := store.(Backuper)
+	if !ok {
+		return fmt.Errorf("%s doesn't support online backups", c.DB)
+	}
+
+	path := *output
+	if path != "" {
+		err = db.Backup(context.Background(), path)
+	} else {
+		path, err = NewBackups(db, c.DB, c.BackupDir, c.BackupKeep).Create(context.Background())
+	}
+	if err != nil {
+		return err
+	}
+	slog.Info("Backed up database", "db", c.DB, "path", path)
+	return nil
+}
+
+// validateBackup checks that the file at path is an intact supchat
+// database this binary can run, and returns its schema version. Backups
+// keep the WAL journal mode, so the file is opened for writing to let
+// SQLite create its shared-memory index; nothing else is written.
+func validateBackup(path string) (int, error) {
+	if _, err := os.Stat(path); err != nil {
+		return 0, err
+	}
+	db, err := InitDB(path, false)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	var result string
+	if err := db.QueryRow("PRAGMA integrity_check").Scan(&result); err != nil {
+		return 0, fmt.Errorf("error checking backup: %w", err)
+	}
+	if result != "ok" {
+		return 0, fmt.Errorf("backup is damaged: %s", result)
+	}
+
+	version, err := db.SchemaVersion()
+	if err != nil {
+		return 0, err
+	}
+	if version == 0 {
+		return 0, errors.New("backup has no schema version, it isn't a supchat database")
+	}
+	if version > sqliteSchema.latest() {
+		return 0, fmt.Errorf("%w: backup is at version %d, binary supports up to %d", ErrSchemaTooNew, version, sqliteSchema.latest())
+	}
+	return version, nil
+}
+
+// rename moves files during a restore. Tests replace it to fail midway.
+var rename = os.Rename
+
+// checkNotInUse returns an error if another connection, such as a running
+// server's, has the SQLite database at path open. It takes SQLite's
+// exclusive lock for a moment, which can't be had while the database is open
+// elsewhere. A missing database is not in use.
+func checkNotInUse(path string) error {
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	db, err := sql.Open("sqlite3", "file:"+path+"?mode=rw&_locking_mode=EXCLUSIVE&_busy_timeout=0")
+	if err != nil {
+		return fmt.Errorf("error opening database: %w", err)
+	}
+	defer db.Close()
+	if _, err := db.Exec("BEGIN EXCLUSIVE; COMMIT"); err != nil {
+		return fmt.Errorf("%s is in use, stop the server before restoring: %w", path, err)
+	}
+	return nil
+}
+
+// restoreBackup replaces the database at dbPath with a copy of the backup.
+// The current database and its WAL files are kept beside it with a
+// .pre-restore suffix. It refuses while a server has the database open.
+func restoreBackup(backup, dbPath string) error {
+	if err := checkNotInUse(dbPath); err != nil {
+		return err
+	}
+
+	// Validate a copy, so the backup itself is never opened and a failure
+	// leaves the current database in place.
+	tmp := dbPath + ".restore"
+	removeTmp := func() {
+		for _, ext := range []string{"", "-wal", "-shm"} {
+			os.Remove(tmp + ext)
+		}
+	}
+	removeTmp()
+	if err := copyFile(backup, tmp); err != nil {
+		removeTmp()
+		return fmt.Errorf("error copying backup: %w", err)
+	}
+	version, err := validateBackup(tmp)
+	if err != nil {
+		removeTmp()
+		return err
+	}
+
+	// On failure, whatever was moved aside goes back.
+	suffix := ".pre-restore-" + time.Now().UTC().Format(backupTimeFormat)
+	var moved []string
+	rollback := func() {
+		for _, ext := range moved {
+			if err := rename(dbPath+suffix+ext, dbPath+ext); err != nil {
+				slog.Error("Error moving database back", "path", dbPath+suffix+ext, "err", err)
+			}
+		}
+		removeTmp()
+	}
+	for _, ext := range []string{"", "-wal", "-shm"} {
+		err := rename(dbPath+ext, dbPath+suffix+ext)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			rollback()
+			return fmt.Errorf("error moving current database aside: %w", err)
+		}
+		moved = append(moved, ext)
+	}
+	if err := rename(tmp, dbPath); err != nil {
+		rollback()
+		return fmt.Errorf("error restoring backup: %w", err)
+	}
+
+	slog.Info("Restored database", "db", dbPath, "backup", backup, "version", version, "previous", dbPath+suffix)
+	if version < sqliteSchema.latest() {
+		slog.Info("The server will migrate the database on startup", "from", version, "to", sqliteSchema.latest())
+	}
+	return nil
+}
+
+// copyFile copies src to a new file dst and syncs it to disk.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	f, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, in); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// runRestore implements the restore command.
+func runRestore(args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	c, err := parseCommand(flags, "BACKUP", args, 1)
+	if err != nil {
+		return err
+	}
+	return restoreBackup(flags.Arg(0), c.DB)
+}
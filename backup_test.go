@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// openTestDB returns a migrated SQLite database in a temporary directory.
+func openTestDB(t *testing.T, path string) *DB {
+	t.Helper()
+	db, err := OpenDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestBackupRotationAndRestore(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "chat.db")
+	db := openTestDB(t, dbPath)
+	db.CreateUser(ctx, "alice", "hash")
+	db.CreateRoom(ctx, "lobby", "alice")
+	for i := 0; i < 100; i++ {
+		db.StoreMessage(ctx, "lobby", "alice", fmt.Sprint(i), "Monday 3:04PM")
+	}
+
+	backups := NewBackups(db, dbPath, filepath.Join(dir, "backups"), 2)
+	var paths []string
+	for i := 0; i < 3; i++ {
+		path, err := backups.Create(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+	left, _ := filepath.Glob(filepath.Join(dir, "backups", "chat-*.db"))
+	if len(left) != 2 || left[0] != paths[1] || left[1] != paths[2] {
+		t.Fatalf("backups after rotation = %v, want %v", left, paths[1:])
+	}
+
+	// Messages written after the backup are gone once it is restored.
+	db.StoreMessage(ctx, "lobby", "alice", "after", "Monday 3:04PM")
+	db.Close()
+	if err := restoreBackup(paths[2], dbPath); err != nil {
+		t.Fatal(err)
+	}
+	db = openTestDB(t, dbPath)
+	defer db.Close()
+	messages, err := db.GetRoomMessages(ctx, "lobby", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 100 || messages[99].Content != "99" {
+		t.Errorf("restored %d messages, want the 100 in the backup", len(messages))
+	}
+	if previous, _ := filepath.Glob(dbPath + ".pre-restore-*"); len(previous) == 0 {
+		t.Error("previous database was not kept")
+	}
+}
+
+func TestRestoreValidatesBackup(t *testing.T) {
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "chat.db")
+	openTestDB(t, dbPath).Close()
+
+	newer := filepath.Join(dir, "newer.db")
+	db := openTestDB(t, newer)
+	if _, err := db.Exec("INSERT INTO schema_migrations (version, description, applied_at) VALUES (?, 'from the future', '')", sqliteSchema.latest()+1); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	if err := restoreBackup(newer, dbPath); !errors.Is(err, ErrSchemaTooNew) {
+		t.Errorf("restoring a newer schema: err = %v, want ErrSchemaTooNew", err)
+	}
+
+	garbage := filepath.Join(dir, "garbage.db")
+	os.WriteFile(garbage, []byte("not a database"), 0o644)
+	if err := restoreBackup(garbage, dbPath); err == nil {
+		t.Error("restoring a file that isn't a database succeeded")
+	}
+
+	if pre, _ := filepath.Glob(dbPath + ".pre-restore-*"); len(pre) != 0 {
+		t.Errorf("failed restores moved the database aside: %v", pre)
+	}
+}
+
+func TestRestoreLeavesDatabaseOnFailure(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "chat.db")
+	db := openTestDB(t, dbPath)
+	db.CreateUser(ctx, "alice", "hash")
+	backup := filepath.Join(dir, "backup.db")
+	if err := db.Backup(ctx, backup); err != nil {
+		t.Fatal(err)
+	}
+	db.CreateUser(ctx, "bob", "hash")
+
+	// A running server has the database open.
+	if err := restoreBackup(backup, dbPath); err == nil || !strings.Contains(err.Error(), "in use") {
+		t.Errorf("restoring under a running server: %v", err)
+	}
+	db.Close()
+
+	// Moving the backup into place fails after the database was moved aside.
+	rename = func(from, to string) error {
+		if strings.HasSuffix(from, ".restore") {
+			return errors.New("disk on fire")
+		}
+		return os.Rename(from, to)
+	}
+	defer func() { rename = os.Rename }()
+	if err := restoreBackup(backup, dbPath); err == nil {
+		t.Fatal("restore succeeded")
+	}
+	if left, _ := filepath.Glob(dbPath + ".*"); len(left) != 0 {
+		t.Errorf("failed restore left %v", left)
+	}
+	db = openTestDB(t, dbPath)
+	defer db.Close()
+	if bob, _ := db.GetUser(ctx, "bob"); bob == nil {
+		t.Error("failed restore lost the current database")
+	}
+}
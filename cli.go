@@ -0,0 +1,428 @@
+// cli.go
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/term"
+)
+
+// Admin commands work on the database directly, whether or not a server is
+// using it. Each change is a single statement or transaction, which SQLite
+// serializes with the server's writes (waiting out its busy timeout) and
+// PostgreSQL isolates as usual. A running server sees the change on its next
+// login or page load, and rooms open on it notice an archive within
+// archivedRefreshInterval (10 seconds); WebSocket clients of disabled users or
+// purged sessions stay connected until they reconnect, so use the admin console
+// to disconnect them at once.
+
+// usage describes the commands and the server's flags.
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, `Usage: %s [command] [flags] [args]
+
+Commands:
+  serve                    run the chat server (the default)
+  user list                list users
+  user create USERNAME     create a user, reading the password from the terminal or standard input
+  user disable USERNAME    disable a user and log them out everywhere
+  user enable USERNAME     re-enable a disabled user
+  user reset-password USERNAME
+                           set a new password and log the user out everywhere
+  room list                list rooms, archived ones included
+  room archive ROOM        make a room read-only and hide it from the home page
+  room unarchive ROOM      open an archived room again
+  sessions purge           log out every session, or those matched by -user and -older-than
+  migrate                  apply pending schema migrations
+  backup                   copy the database while it is in use
+  restore BACKUP           replace the database with a backup; stop the server first
+  export ROOM              write a room's history as JSON lines, CSV or HTML
+  import PATH              import a Slack export or JSON lines
+  config print             show the settings the server would run with
+
+Run a command with -h for its flags. The server's flags are:
+`, os.Args[0])
+	flag.PrintDefaults()
+}
+
+// dialCurrentStore opens the store named by dsn for an admin command. Unlike
+// openStore it never migrates, so a command can't change the schema under a
+// running server; the schema must be current already.
+func dialCurrentStore(dsn string) (Store, error) {
+	if dsn == memoryDSN {
+		return nil, errors.New("admin commands need a SQLite file or postgres:// URL")
+	}
+	if !isPostgresDSN(dsn) {
+		// Opening a missing file would create an empty database.
+		if _, err := os.Stat(dsn); err != nil {
+			return nil, fmt.Errorf("error opening database: %w", err)
+		}
+	}
+	store, err := dialStore(dsn)
+	if err != nil {
+		return nil, err
+	}
+	if m, ok := store.(Migrator); ok {
+		pending, err := m.PendingMigrations()
+		if err != nil {
+			store.Close()
+			return nil, err
+		}
+		if len(pending) > 0 {
+			store.Close()
+			return nil, fmt.Errorf("%s has %d pending schema migrations, run %s migrate first", dsn, len(pending), os.Args[0])
+		}
+	}
+	return store, nil
+}
+
+// parseCommand parses the flags of a command taking nargs arguments,
+// described by usage. Commands take the server's settings too, so they
+// find the database (and backups) the way a server given the same -config
+// file, environment and flags would.
+func parseCommand(flags *flag.FlagSet, usage string, args []string, nargs int) (*Config, error) {
+	own := flag.NewFlagSet(flags.Name(), flag.ContinueOnError)
+	flags.VisitAll(func(f *flag.Flag) { own.Var(f.Value, f.Name, f.Usage) })
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s %s [flags] %s\n", os.Args[0], flags.Name(), usage)
+		own.SetOutput(flags.Output())
+		own.PrintDefaults()
+		fmt.Fprintf(flags.Output(), "The server's settings also apply, from -config, $SUPCHAT_* or flags; -db names the database.\n")
+	}
+
+	c, err := loadConfig(flags, args)
+	if err != nil {
+		return nil, err
+	}
+	if flags.NArg() != nargs {
+		flags.Usage()
+		os.Exit(2)
+	}
+	return c, nil
+}
+
+// readPassword reads a new password, prompting for it twice without echo
+// on a terminal and otherwise taking the first line of in.
+func readPassword(in io.Reader) (string, error) {
+	if f, ok := in.(*os.File); ok && term.IsTerminal(int(f.Fd())) {
+		fmt.Fprint(os.Stderr, "Password: ")
+		password, err := term.ReadPassword(int(f.Fd()))
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprint(os.Stderr, "Repeat password: ")
+		again, err := term.ReadPassword(int(f.Fd()))
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return "", err
+		}
+		if string(again) != string(password) {
+			return "", errors.New("passwords don't match")
+		}
+		return string(password), nil
+	}
+
+	line, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	password := strings.TrimRight(line, "\r\n")
+	if password == "" {
+		return "", errors.New("password is required")
+	}
+	return password, nil
+}
+
+// runUser implements the user commands.
+func runUser(args []string, in io.Reader, out io.Writer) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: %s user list|create|disable|enable|reset-password [flags] [USERNAME]", os.Args[0])
+	}
+	ctx := context.Background()
+
+	switch args[0] {
+	case "list":
+		c, err := parseCommand(flag.NewFlagSet("user list", flag.ExitOnError), "", args[1:], 0)
+		if err != nil {
+			return err
+		}
+		store, err := dialCurrentStore(c.DB)
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+
+		users, err := store.ListUsers(ctx)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "USERNAME\tADMIN\tDISABLED")
+		for _, user := range users {
+			fmt.Fprintf(w, "%s\t%t\t%t\n", user.Username, user.IsAdmin, user.Disabled)
+		}
+		return w.Flush()
+
+	case "create", "reset-password":
+		flags := flag.NewFlagSet("user "+args[0], flag.ExitOnError)
+		admin := false
+		if args[0] == "create" {
+			flags.BoolVar(&admin, "admin", false, "make the user an admin")
+		}
+		c, err := parseCommand(flags, "USERNAME", args[1:], 1)
+		if err != nil {
+			return err
+		}
+		username := flags.Arg(0)
+
+		store, err := dialCurrentStore(c.DB)
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+
+		user, err := store.GetUser(ctx, username)
+		if err != nil {
+			return err
+		}
+		if args[0] == "create" && user != nil {
+			return fmt.Errorf("user %q already exists", username)
+		}
+		if args[0] == "reset-password" && user == nil {
+			return fmt.Errorf("user %q not found", username)
+		}
+
+		password, err := readPassword(in)
+		if err != nil {
+			return err
+		}
+		hashedPassword, err := hashPassword(password, c.BcryptCost)
+		if err != nil {
+			return err
+		}
+
+		if args[0] == "create" {
+			if err := store.CreateUser(ctx, username, hashedPassword); err != nil {
+				return err
+			}
+			if admin {
+				if err := store.SetAdmin(ctx, username, true); err != nil {
+					return err
+				}
+			}
+			fmt.Fprintf(out, "Created user %s\n", username)
+			return nil
+		}
+		if err := store.SetPassword(ctx, username, hashedPassword); err != nil {
+			return err
+		}
+		if err := store.DeleteUserSessions(ctx, username); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Reset the password of %s and logged them out\n", username)
+		return nil
+
+	case "disable", "enable":
+		flags := flag.NewFlagSet("user "+args[0], flag.ExitOnError)
+		c, err := parseCommand(flags, "USERNAME", args[1:], 1)
+		if err != nil {
+			return err
+		}
+		username := flags.Arg(0)
+		disabled := args[0] == "disable"
+
+		store, err := dialCurrentStore(c.DB)
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+
+		user, err := store.GetUser(ctx, username)
+		if err != nil {
+			return err
+		}
+		if user == nil {
+			return fmt.Errorf("user %q not found", username)
+		}
+		if err := store.SetUserDisabled(ctx, username, disabled); err != nil {
+			return err
+		}
+		if !disabled {
+			fmt.Fprintf(out, "Enabled %s\n", username)
+			return nil
+		}
+		if err := store.DeleteUserSessions(ctx, username); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Disabled %s and logged them out\n", username)
+		return nil
+	}
+	return fmt.Errorf("unknown user command %q", args[0])
+}
+
+// runRoom implements the room commands.
+func runRoom(args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: %s room list|archive|unarchive [flags] [ROOM]", os.Args[0])
+	}
+	ctx := context.Background()
+
+	switch args[0] {
+	case "list":
+		c, err := parseCommand(flag.NewFlagSet("room list", flag.ExitOnError), "", args[1:], 0)
+		if err != nil {
+			return err
+		}
+		store, err := dialCurrentStore(c.DB)
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+
+		rooms, err := store.ListRooms(ctx)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ROOM\tOWNER\tARCHIVED\tLEGAL HOLD")
+		for _, room := range rooms {
+			fmt.Fprintf(w, "%s\t%s\t%t\t%t\n", room.ID, room.Owner, room.Archived, room.LegalHold)
+		}
+		return w.Flush()
+
+	case "archive", "unarchive":
+		flags := flag.NewFlagSet("room "+args[0], flag.ExitOnError)
+		c, err := parseCommand(flags, "ROOM", args[1:], 1)
+		if err != nil {
+			return err
+		}
+		roomID := flags.Arg(0)
+
+		store, err := dialCurrentStore(c.DB)
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+
+		room, err := store.GetRoom(ctx, roomID)
+		if err != nil {
+			return err
+		}
+		if room == nil {
+			return fmt.Errorf("room %q not found", roomID)
+		}
+		archived := args[0] == "archive"
+		if err := store.SetRoomArchived(ctx, roomID, archived); err != nil {
+			return err
+		}
+		if archived {
+			fmt.Fprintf(out, "Archived %s; open clients follow within %s\n", roomID, archivedRefreshInterval)
+		} else {
+			fmt.Fprintf(out, "Unarchived %s; open clients follow within %s\n", roomID, archivedRefreshInterval)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown room command %q", args[0])
+}
+
+// runSessions implements the sessions commands.
+func runSessions(args []string, out io.Writer) error {
+	if len(args) == 0 || args[0] != "purge" {
+		return fmt.Errorf("usage: %s sessions purge [flags]", os.Args[0])
+	}
+	flags := flag.NewFlagSet("sessions purge", flag.ExitOnError)
+	username := flags.String("user", "", "only purge this user's sessions")
+	olderThan := flags.Duration("older-than", 0, "only purge sessions older than this; sessions from before their creation was recorded count as older")
+	c, err := parseCommand(flags, "", args[1:], 0)
+	if err != nil {
+		return err
+	}
+
+	store, err := dialCurrentStore(c.DB)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	ctx := context.Background()
+	sessions, err := store.ListSessions(ctx)
+	if err != nil {
+		return err
+	}
+	cutoff := time.Now().Add(-*olderThan)
+	purged := 0
+	for _, session := range sessions {
+		if *username != "" && session.Username != *username {
+			continue
+		}
+		if *olderThan > 0 && !session.CreatedAt.IsZero() && session.CreatedAt.After(cutoff) {
+			continue
+		}
+		if err := store.DeleteSession(ctx, session.Token); err != nil {
+			return err
+		}
+		purged++
+	}
+	fmt.Fprintf(out, "Purged %d of %d sessions\n", purged, len(sessions))
+	return nil
+}
+
+// runMigrate implements the migrate command. Migrations run in a single
+// transaction; stop servers running an older binary first, since they
+// refuse to start on a newer schema and may misbehave if already running.
+func runMigrate(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "list pending migrations without applying them")
+	c, err := parseCommand(flags, "", args, 0)
+	if err != nil {
+		return err
+	}
+
+	store, err := dialStore(c.DB)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	m, ok := store.(Migrator)
+	if !ok {
+		fmt.Fprintln(out, "Nothing to migrate")
+		return nil
+	}
+	pending, err := m.PendingMigrations()
+	if err != nil {
+		return err
+	}
+	if *dryRun {
+		printPendingMigrations(out, pending)
+		return nil
+	}
+	if err := m.Migrate(); err != nil {
+		return err
+	}
+	for _, m := range pending {
+		fmt.Fprintf(out, "Applied migration %d: %s\n", m.version, m.description)
+	}
+	fmt.Fprintln(out, "Database schema is up to date")
+	return nil
+}
+
+// printPendingMigrations lists the migrations a migrate would apply.
+func printPendingMigrations(out io.Writer, pending []migration) {
+	if len(pending) == 0 {
+		fmt.Fprintln(out, "Database schema is up to date")
+	}
+	for _, m := range pending {
+		fmt.Fprintf(out, "Would apply migration %d: %s\n", m.version, m.description)
+	}
+}
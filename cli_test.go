@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestAdminCommandsAlongsideServer(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "chat.db")
+
+	// Commands refuse a database that needs migrating, then migrate it.
+	server, err := OpenDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	if err := runRoom([]string{"list", "-db", path}, &bytes.Buffer{}); err == nil || !strings.Contains(err.Error(), "migrate first") {
+		t.Errorf("room list on an unmigrated database: %v", err)
+	}
+	var out bytes.Buffer
+	if err := runMigrate([]string{"-db", path}, &out); err != nil || !strings.Contains(out.String(), "up to date") {
+		t.Fatalf("migrate: %v %q", err, out.String())
+	}
+
+	// The server's handle stays open throughout, as it would while running.
+	server.CreateUser(ctx, "alice", "hash")
+	server.CreateRoom(ctx, "lobby", "alice")
+	server.CreateSession(ctx, "alice-1", "alice")
+	server.CreateSession(ctx, "alice-2", "alice")
+
+	out.Reset()
+	if err := runUser([]string{"create", "-db", path, "-admin", "-bcrypt-cost", "4", "bob"}, strings.NewReader("hunter22\n"), &out); err != nil {
+		t.Fatal(err)
+	}
+	bob, err := server.GetUser(ctx, "bob")
+	if err != nil || bob == nil || !bob.IsAdmin || !verifyPassword(bob.HashedPassword, "hunter22") {
+		t.Fatalf("bob after user create: %+v, %v", bob, err)
+	}
+	if err := runUser([]string{"create", "-db", path, "bob"}, strings.NewReader("again\n"), &out); err == nil {
+		t.Error("created bob twice")
+	}
+	server.CreateSession(ctx, "bob-1", "bob")
+
+	if err := runUser([]string{"reset-password", "-db", path, "-bcrypt-cost", "4", "bob"}, strings.NewReader("correct horse\n"), &out); err != nil {
+		t.Fatal(err)
+	}
+	if bob, _ := server.GetUser(ctx, "bob"); !verifyPassword(bob.HashedPassword, "correct horse") {
+		t.Error("reset-password kept the old password")
+	}
+	if user, _ := server.GetUserFromSession(ctx, "bob-1"); user != nil {
+		t.Error("reset-password left bob logged in")
+	}
+
+	if err := runUser([]string{"disable", "-db", path, "alice"}, nil, &out); err != nil {
+		t.Fatal(err)
+	}
+	if alice, _ := server.GetUser(ctx, "alice"); !alice.Disabled {
+		t.Error("alice isn't disabled")
+	}
+	if user, _ := server.GetUserFromSession(ctx, "alice-1"); user != nil {
+		t.Error("disable left alice logged in")
+	}
+	out.Reset()
+	if err := runUser([]string{"list", "-db", path}, nil, &out); err != nil || !strings.Contains(out.String(), "alice     false  true") {
+		t.Errorf("user list: %v\n%s", err, out.String())
+	}
+
+	if err := runRoom([]string{"archive", "-db", path, "lobby"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if room, _ := server.GetRoom(ctx, "lobby"); !room.Archived {
+		t.Error("lobby isn't archived")
+	}
+	if err := runRoom([]string{"archive", "-db", path, "nowhere"}, &out); err == nil {
+		t.Error("archived a missing room")
+	}
+
+	server.CreateSession(ctx, "bob-2", "bob")
+	server.CreateSession(ctx, "bob-3", "bob")
+	server.SetUserDisabled(ctx, "alice", false)
+	server.CreateSession(ctx, "alice-3", "alice")
+	out.Reset()
+	if err := runSessions([]string{"purge", "-db", path, "-user", "bob", "-older-than", "1h"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "Purged 0 of 3") {
+		t.Errorf("purging bob's old sessions: %q", out.String())
+	}
+	out.Reset()
+	if err := runSessions([]string{"purge", "-db", path, "-user", "bob"}, &out); err != nil || !strings.Contains(out.String(), "Purged 2 of 3") {
+		t.Errorf("purging bob's sessions: %v %q", err, out.String())
+	}
+	if user, _ := server.GetUserFromSession(ctx, "alice-3"); user == nil {
+		t.Error("purging bob's sessions logged alice out")
+	}
+}
+
+func TestCommandsFindConfiguredDatabase(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "configured.db")
+	db := openTestDB(t, path)
+	defer db.Close()
+	db.CreateUser(ctx, "alice", "hash")
+	db.CreateRoom(ctx, "lobby", "alice")
+
+	config := filepath.Join(dir, "supchat.toml")
+	if err := os.WriteFile(config, []byte(fmt.Sprintf("db = %q\n", path)), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := runRoom([]string{"list", "-config", config}, &out); err != nil || !strings.Contains(out.String(), "lobby") {
+		t.Errorf("room list with -config: %v %q", err, out.String())
+	}
+
+	t.Setenv("SUPCHAT_DB", path)
+	out.Reset()
+	if err := runRoom([]string{"list"}, &out); err != nil || !strings.Contains(out.String(), "lobby") {
+		t.Errorf("room list with $SUPCHAT_DB: %v %q", err, out.String())
+	}
+}
+
+func TestRoomArchiveReachesRunningHub(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "chat.db")
+	db := openTestDB(t, path)
+	defer db.Close()
+	db.CreateUser(ctx, "alice", "hash")
+	db.CreateSession(ctx, "token", "alice")
+
+	persister := NewPersister(db)
+	defer persister.Close()
+	rm := &RoomManager{
+		Rooms:           make(map[string]*Hub),
+		db:              db,
+		persister:       persister,
+		connLimits:      defaultConfig().connLimits(),
+		archivedRefresh: 10 * time.Millisecond,
+	}
+	defer func() {
+		for _, hub := range rm.hubs() {
+			hub.stop(websocket.CloseGoingAway, "")
+		}
+	}()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.SetPathValue("chatRoom", "lobby")
+		serveWs(rm, w, r)
+	}))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), http.Header{"Cookie": {"SessionToken=token"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var m Message
+	if err := conn.ReadJSON(&m); err != nil || m.Type != "join" {
+		t.Fatalf("first message %+v, %v", m, err)
+	}
+
+	// The hub is running when the command archives its room, and tells
+	// its clients once it notices.
+	if err := runRoom([]string{"archive", "-db", path, "lobby"}, &bytes.Buffer{}); err != nil {
+		t.Fatal(err)
+	}
+	for m.Type != "archived" {
+		if err := conn.ReadJSON(&m); err != nil {
+			t.Fatalf("waiting for the archive notice: %v", err)
+		}
+	}
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("still open?")); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		if err := conn.ReadJSON(&m); err != nil {
+			t.Fatalf("waiting for the post to be rejected: %v", err)
+		}
+		if m.Type == "message" {
+			t.Fatal("posted to a room archived by the room command")
+		}
+		if m.Type == "error" && strings.Contains(m.Content, "archived") {
+			break
+		}
+	}
+	if messages, _ := db.GetRoomMessages(ctx, "lobby", 0); len(messages) != 1 {
+		t.Errorf("lobby has %d messages, want only alice's join", len(messages))
+	}
+}
@@ -3,28 +3,40 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
-	"log"
+	"fmt"
+	"log/slog"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/trace"
 )
 
-// Constants for WebSocket connection parameters.
-const (
+// Outbound messages buffered per client before it counts as a slow consumer.
+const sendBufferSize = 256
+
+// historyLimit caps the history sent to a joining client. It leaves room in
+// the send buffer, so that a new client always takes its history.
+const historyLimit = 200
+
+// ConnLimits are the WebSocket connection parameters of a client.
+type ConnLimits struct {
 	// Time allowed to write a message to the peer.
-	writeWait = 10 * time.Second
+	WriteWait time.Duration
 
 	// Time allowed to read the next pong message from the peer.
-	pongWait = 60 * time.Second
-
-	// Send pings to peer with this period. Must be less than pongWait.
-	pingPeriod = (pongWait * 9) / 10
+	PongWait time.Duration
 
 	// Maximum message size allowed from peer.
-	maxMessageSize = 512
-)
+	MaxMessageSize int64
+}
 
+// pingPeriod is how often pings are sent to the peer. It is less than
+// PongWait so a pong can arrive in time.
+func (l ConnLimits) pingPeriod() time.Duration {
+	return (l.PongWait * 9) / 10
+}
 
 // upgrader is used to upgrade HTTP connections to WebSocket connections.
 var upgrader = websocket.Upgrader{
@@ -44,6 +56,36 @@ type Client struct {
 
 	// User associated with the client.
 	user *User
+
+	// Connection ID, and a log of the connection's events tagged with it,
+	// the room and the user.
+	id  string
+	log *slog.Logger
+
+	// The upgrade request's context without its cancellation, carrying its
+	// logger and trace span for work done on the client's behalf.
+	ctx context.Context
+
+	// Connection parameters from the configuration.
+	connLimits ConnLimits
+
+	// Close code and reason sent to the peer once the hub closes send.
+	// Written by the hub before closing the channel.
+	closeCode int
+	closeText string
+
+	// Row ID of the last message in the history sent on registration, so
+	// the hub doesn't deliver stored broadcasts twice. Owned by the hub.
+	historyID int64
+}
+
+// closeMessage returns the payload of the close frame sent when the hub
+// closes the send channel.
+func (c *Client) closeMessage() []byte {
+	if c.closeCode == 0 {
+		return []byte{}
+	}
+	return websocket.FormatCloseMessage(c.closeCode, c.closeText)
 }
 
 // readPump pumps messages from the websocket connection to the hub.
@@ -55,17 +97,21 @@ type Client struct {
 func (c *Client) readPump() {
     defer func() {
         // Unregister the client and close the connection when the function exits.
-        c.hub.unregister <- c
+        select {
+        case c.hub.unregister <- c:
+        case <-c.hub.done:
+        }
         c.conn.Close()
+        c.log.Info("Client disconnected")
     }()
 
     // Set maximum message size and read deadline.
-    c.conn.SetReadLimit(maxMessageSize)
-    c.conn.SetReadDeadline(time.Now().Add(pongWait))
+    c.conn.SetReadLimit(c.connLimits.MaxMessageSize)
+    c.conn.SetReadDeadline(time.Now().Add(c.connLimits.PongWait))
 
     // Set pong handler to update the read deadline.
     c.conn.SetPongHandler(func(string) error {
-        c.conn.SetReadDeadline(time.Now().Add(pongWait))
+        c.conn.SetReadDeadline(time.Now().Add(c.connLimits.PongWait))
         return nil
     })
 
@@ -75,21 +121,52 @@ func (c *Client) readPump() {
         if err != nil {
             // Handle unexpected close errors.
             if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-                log.Printf("error: %v", err)
+                c.log.Warn("Connection closed unexpectedly", "err", err)
             }
             break
         }
 
+        // Trace each frame on its own, linked to the connection's request.
+        ctx, span := tracer().Start(context.Background(), "websocket message",
+            trace.WithNewRoot(), trace.WithLinks(trace.LinkFromContext(c.ctx)),
+            trace.WithSpanKind(trace.SpanKindServer), roomAttributes(c.hub.roomID, c.user.Username, c.id))
+
+        // Archived rooms are read-only.
+        if c.hub.archived.Load() {
+            c.hub.sendTo(c, Message{Type: "error", Content: "This room is archived and read-only"})
+            span.AddEvent("rejected: room archived")
+            span.End()
+            continue
+        }
+
+        // Throttled messages are returned to the sender instead of being broadcast.
+        if ok, wait := c.hub.allowSend(c.user.Username); !ok {
+            c.hub.sendTo(c, Message{
+                Type:    "throttled",
+                Content: fmt.Sprintf("You are sending messages too fast. Try again in %s.", (wait + time.Second - 1).Truncate(time.Second)),
+            })
+            span.AddEvent("throttled")
+            span.End()
+            continue
+        }
+
         // Prepare the full message to broadcast.
         fullMessage := Message{
             Type:      "message",
             Content:   string(message),
             User:      c.user.Username,
-            Timestamp: time.Now().Format("Monday 3:04PM"),
+            Timestamp: formatTimestamp(time.Now()),
+            ctx:       ctx,
         }
 
         // Broadcast the message to all clients in the hub.
-        c.hub.broadcast <- fullMessage
+        select {
+        case c.hub.broadcast <- fullMessage:
+            span.End()
+        case <-c.hub.done:
+            span.End()
+            return
+        }
     }
 }
 
@@ -101,7 +178,7 @@ func (c *Client) readPump() {
 // writer to a connection by executing all writes from this goroutine.
 func (c *Client) writePump() {
     // Create a ticker for periodic pings to the client.
-    ticker := time.NewTicker(pingPeriod)
+    ticker := time.NewTicker(c.connLimits.pingPeriod())
     defer func() {
         ticker.Stop()
         c.conn.Close()
@@ -111,10 +188,10 @@ func (c *Client) writePump() {
         select {
         case message, ok := <-c.send:
             // Set write deadline for the message.
-            c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+            c.conn.SetWriteDeadline(time.Now().Add(c.connLimits.WriteWait))
             if !ok {
                 // Hub closed the channel.
-                c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+                c.conn.WriteMessage(websocket.CloseMessage, c.closeMessage())
                 return
             }
 
@@ -136,7 +213,7 @@ func (c *Client) writePump() {
 
         case <-ticker.C:
             // Send a ping to the client to maintain connection.
-            c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+            c.conn.SetWriteDeadline(time.Now().Add(c.connLimits.WriteWait))
             if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
                 return
             }
@@ -0,0 +1,339 @@
+// config.go
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Config holds the server's settings. Each setting is read, from lowest
+// to highest precedence, from its default, the TOML file named by -config
+// or $SUPCHAT_CONFIG, the environment variable SUPCHAT_<NAME> and the
+// command line flag -<name>. In the file, names use underscores instead of
+// dashes: -hub-idle-timeout is hub_idle_timeout and $SUPCHAT_HUB_IDLE_TIMEOUT.
+type Config struct {
+	Port   string   `toml:"port"`
+	DB     string   `toml:"db"`
+	Admins []string `toml:"admins"`
+
+	LogLevel  string `toml:"log_level"`
+	LogFormat string `toml:"log_format"`
+
+	OTLPEndpoint     string  `toml:"otlp_endpoint"`
+	TraceSampleRatio float64 `toml:"trace_sample_ratio"`
+	MetricsAddr      string  `toml:"metrics_addr"`
+
+	Dev         bool   `toml:"dev"`
+	TemplateDir string `toml:"template_dir"`
+	AssetDir    string `toml:"asset_dir"`
+
+	ShutdownTimeout time.Duration `toml:"shutdown_timeout"`
+	DrainDelay      time.Duration `toml:"drain_delay"`
+	HubIdleTimeout  time.Duration `toml:"hub_idle_timeout"`
+
+	UserRate  float64 `toml:"user_rate"`
+	UserBurst int     `toml:"user_burst"`
+	RoomRate  float64 `toml:"room_rate"`
+	RoomBurst int     `toml:"room_burst"`
+
+	MaxMessageSize int64         `toml:"max_message_size"`
+	PongWait       time.Duration `toml:"pong_wait"`
+	WriteWait      time.Duration `toml:"write_wait"`
+	BcryptCost     int           `toml:"bcrypt_cost"`
+
+	RetainDays     int           `toml:"retain_days"`
+	RetainMessages int           `toml:"retain_messages"`
+	PruneInterval  time.Duration `toml:"prune_interval"`
+
+	BackupDir      string        `toml:"backup_dir"`
+	BackupInterval time.Duration `toml:"backup_interval"`
+	BackupKeep     int           `toml:"backup_keep"`
+
+	TLSCert       string   `toml:"tls_cert"`
+	TLSKey        string   `toml:"tls_key"`
+	ACMEDomains   []string `toml:"acme_domains"`
+	ACMEEmail     string   `toml:"acme_email"`
+	ACMEDirectory string   `toml:"acme_directory"`
+	ACMECacheDir  string   `toml:"acme_cache_dir"`
+	ACMECAFile    string   `toml:"acme_ca_file"`
+	HTTPPort      string   `toml:"http_port"`
+}
+
+// defaultConfig returns the settings used when nothing overrides them.
+func defaultConfig() *Config {
+	return &Config{
+		Port:             "8000",
+		DB:               "chat.db",
+		Admins:           []string{},
+		LogLevel:         "info",
+		LogFormat:        "text",
+		TraceSampleRatio: 1,
+		TemplateDir:      "templates",
+		AssetDir:         "assets",
+		ShutdownTimeout:  10 * time.Second,
+		HubIdleTimeout:   5 * time.Minute,
+		UserRate:         2,
+		UserBurst:        10,
+		RoomRate:         20,
+		RoomBurst:        50,
+		MaxMessageSize:   512,
+		PongWait:         60 * time.Second,
+		WriteWait:        10 * time.Second,
+		BcryptCost:       bcrypt.DefaultCost,
+		PruneInterval:    time.Hour,
+		BackupDir:        "backups",
+		BackupKeep:       7,
+		ACMEDomains:      []string{},
+		ACMEDirectory:    autocert.DefaultACMEDirectory,
+		ACMECacheDir:     "acme-cache",
+	}
+}
+
+// register defines a flag for every setting, defaulting to its current
+// value, and returns the flags' names.
+func (c *Config) register(fs *flag.FlagSet) []string {
+	before := make(map[string]bool)
+	fs.VisitAll(func(f *flag.Flag) { before[f.Name] = true })
+
+	fs.StringVar(&c.Port, "port", c.Port, "specify the port to listen on")
+	fs.StringVar(&c.DB, "db", c.DB, "SQLite database file, postgres:// URL, or :memory: to keep everything in memory")
+	fs.Var((*listFlag)(&c.Admins), "admins", "comma-separated usernames granted admin rights")
+	fs.StringVar(&c.LogLevel, "log-level", c.LogLevel, "least severe log level to write: debug, info, warn or error")
+	fs.StringVar(&c.LogFormat, "log-format", c.LogFormat, "log format: text (key=value pairs) or json (one object per line)")
+	fs.StringVar(&c.OTLPEndpoint, "otlp-endpoint", c.OTLPEndpoint, "export traces to this OTLP/HTTP collector, like http://localhost:4318 (empty disables tracing)")
+	fs.Float64Var(&c.TraceSampleRatio, "trace-sample-ratio", c.TraceSampleRatio, "fraction of traces to record, unless the client's trace context says otherwise")
+	fs.StringVar(&c.MetricsAddr, "metrics-addr", c.MetricsAddr, "serve Prometheus metrics at /metrics on this address, like localhost:9090, apart from the chat (empty disables metrics)")
+	fs.BoolVar(&c.Dev, "dev", c.Dev, "serve templates and assets from -template-dir and -asset-dir, re-reading them on every request, instead of the copies built into the binary")
+	fs.StringVar(&c.TemplateDir, "template-dir", c.TemplateDir, "directory holding the page templates, with -dev")
+	fs.StringVar(&c.AssetDir, "asset-dir", c.AssetDir, "directory served at /assets/, with -dev")
+	fs.DurationVar(&c.ShutdownTimeout, "shutdown-timeout", c.ShutdownTimeout, "how long to wait for connections to close on shutdown")
+	fs.DurationVar(&c.DrainDelay, "drain-delay", c.DrainDelay, "on shutdown, fail /readyz and refuse new WebSocket clients for this long before closing the listener")
+	fs.DurationVar(&c.HubIdleTimeout, "hub-idle-timeout", c.HubIdleTimeout, "shut down a room's hub after it has been empty this long (0 keeps hubs forever)")
+	fs.Float64Var(&c.UserRate, "user-rate", c.UserRate, "messages per second each user may send across all rooms (0 disables)")
+	fs.IntVar(&c.UserBurst, "user-burst", c.UserBurst, "burst size for -user-rate")
+	fs.Float64Var(&c.RoomRate, "room-rate", c.RoomRate, "messages per second each room accepts across all users (0 disables)")
+	fs.IntVar(&c.RoomBurst, "room-burst", c.RoomBurst, "burst size for -room-rate")
+	fs.Int64Var(&c.MaxMessageSize, "max-message-size", c.MaxMessageSize, "largest WebSocket message in bytes accepted from a client")
+	fs.DurationVar(&c.PongWait, "pong-wait", c.PongWait, "disconnect clients that don't answer a ping within this long")
+	fs.DurationVar(&c.WriteWait, "write-wait", c.WriteWait, "time allowed to write a message to a client")
+	fs.IntVar(&c.BcryptCost, "bcrypt-cost", c.BcryptCost, fmt.Sprintf("bcrypt cost of new password hashes (%d to %d)", bcrypt.MinCost, bcrypt.MaxCost))
+	fs.IntVar(&c.RetainDays, "retain-days", c.RetainDays, "delete messages older than this many days (0 keeps them forever, rooms may override)")
+	fs.IntVar(&c.RetainMessages, "retain-messages", c.RetainMessages, "keep at most this many messages per room (0 keeps all, rooms may override)")
+	fs.DurationVar(&c.PruneInterval, "prune-interval", c.PruneInterval, "how often to delete messages past their retention (0 disables pruning)")
+	fs.StringVar(&c.BackupDir, "backup-dir", c.BackupDir, "directory for online backups of a SQLite database")
+	fs.DurationVar(&c.BackupInterval, "backup-interval", c.BackupInterval, "how often to back up a SQLite database (0 disables scheduled backups)")
+	fs.IntVar(&c.BackupKeep, "backup-keep", c.BackupKeep, "delete all but this many backups in -backup-dir (0 keeps all)")
+	fs.StringVar(&c.TLSCert, "tls-cert", c.TLSCert, "serve HTTPS with this PEM certificate file (requires -tls-key)")
+	fs.StringVar(&c.TLSKey, "tls-key", c.TLSKey, "PEM private key file for -tls-cert")
+	fs.Var((*listFlag)(&c.ACMEDomains), "acme-domains", "comma-separated domains to serve HTTPS for with certificates obtained by ACME")
+	fs.StringVar(&c.ACMEEmail, "acme-email", c.ACMEEmail, "contact email for the ACME account (optional)")
+	fs.StringVar(&c.ACMEDirectory, "acme-directory", c.ACMEDirectory, "ACME directory URL, such as a staging or local test server")
+	fs.StringVar(&c.ACMECacheDir, "acme-cache-dir", c.ACMECacheDir, "directory to keep ACME account keys and certificates in")
+	fs.StringVar(&c.ACMECAFile, "acme-ca-file", c.ACMECAFile, "PEM file of CAs to trust when talking to the ACME server (for test servers)")
+	fs.StringVar(&c.HTTPPort, "http-port", c.HTTPPort, "with TLS, also listen for plain HTTP on this port to redirect to HTTPS and answer ACME challenges")
+
+	var names []string
+	fs.VisitAll(func(f *flag.Flag) {
+		if !before[f.Name] {
+			names = append(names, f.Name)
+		}
+	})
+	return names
+}
+
+// listFlag is a comma-separated list flag. Setting it replaces the list.
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(value string) error {
+	*l = []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+// envName returns the environment variable of the setting with a flag name.
+func envName(flagName string) string {
+	return "SUPCHAT_" + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// loadConfig defines the settings' flags on fs next to any the caller
+// defined, parses args and returns the effective configuration.
+func loadConfig(fs *flag.FlagSet, args []string) (*Config, error) {
+	c := defaultConfig()
+	path := fs.String("config", os.Getenv("SUPCHAT_CONFIG"), "TOML file to read settings from; environment variables and flags override it")
+	names := c.register(fs)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	// Flags win over the file and the environment, so put them back last.
+	given := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = f.Value.String() })
+
+	if *path != "" {
+		if err := c.loadFile(*path); err != nil {
+			return nil, err
+		}
+	}
+	for _, name := range names {
+		value, ok := os.LookupEnv(envName(name))
+		if _, isFlag := given[name]; !ok || isFlag {
+			continue
+		}
+		if err := fs.Set(name, value); err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", envName(name), err)
+		}
+	}
+	for name, value := range given {
+		fs.Set(name, value)
+	}
+
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// loadFile reads settings from a TOML file. Unknown keys are errors so
+// that typos don't go unnoticed.
+func (c *Config) loadFile(path string) error {
+	meta, err := toml.DecodeFile(path, c)
+	if err != nil {
+		return fmt.Errorf("error reading config file: %w", err)
+	}
+	if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+		keys := make([]string, len(undecoded))
+		for i, key := range undecoded {
+			keys[i] = key.String()
+		}
+		return fmt.Errorf("error reading config file %s: unknown settings %s", path, strings.Join(keys, ", "))
+	}
+	return nil
+}
+
+// validate reports every setting that is out of range.
+func (c *Config) validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	port, err := strconv.Atoi(c.Port)
+	check(err == nil && port > 0 && port < 65536, "port must be a number from 1 to 65535, not %q", c.Port)
+	check(c.DB != "", "db must not be empty")
+	var level slog.Level
+	check(level.UnmarshalText([]byte(c.LogLevel)) == nil, "log-level must be debug, info, warn or error, not %q", c.LogLevel)
+	check(c.LogFormat == "text" || c.LogFormat == "json", "log-format must be text or json, not %q", c.LogFormat)
+	if c.OTLPEndpoint != "" {
+		_, err := otlpEndpoint(c.OTLPEndpoint)
+		check(err == nil, "otlp-endpoint: %v", err)
+	}
+	check(c.TraceSampleRatio >= 0 && c.TraceSampleRatio <= 1, "trace-sample-ratio must be from 0 to 1")
+	if c.MetricsAddr != "" {
+		_, port, err := net.SplitHostPort(c.MetricsAddr)
+		check(err == nil && port != "", "metrics-addr must be a host:port address like localhost:9090, not %q", c.MetricsAddr)
+		check(port != c.Port && port != c.HTTPPort, "metrics-addr must not share a port with the chat")
+	}
+	for _, dir := range []struct{ name, path string }{{"template-dir", c.TemplateDir}, {"asset-dir", c.AssetDir}} {
+		if c.Dev {
+			info, err := os.Stat(dir.path)
+			check(err == nil && info.IsDir(), "%s %q is not a directory", dir.name, dir.path)
+		}
+	}
+	check(c.ShutdownTimeout > 0, "shutdown-timeout must be positive")
+	check(c.DrainDelay >= 0, "drain-delay must not be negative")
+	check(c.HubIdleTimeout >= 0, "hub-idle-timeout must not be negative")
+	check(c.UserRate >= 0, "user-rate must not be negative")
+	check(c.UserRate == 0 || c.UserBurst >= 1, "user-burst must be at least 1")
+	check(c.RoomRate >= 0, "room-rate must not be negative")
+	check(c.RoomRate == 0 || c.RoomBurst >= 1, "room-burst must be at least 1")
+	check(c.MaxMessageSize > 0, "max-message-size must be positive")
+	check(c.PongWait > 0, "pong-wait must be positive")
+	check(c.WriteWait > 0, "write-wait must be positive")
+	check(c.BcryptCost >= bcrypt.MinCost && c.BcryptCost <= bcrypt.MaxCost, "bcrypt-cost must be from %d to %d", bcrypt.MinCost, bcrypt.MaxCost)
+	check(c.RetainDays >= 0, "retain-days must not be negative")
+	check(c.RetainMessages >= 0, "retain-messages must not be negative")
+	check(c.PruneInterval >= 0, "prune-interval must not be negative")
+	check(c.BackupInterval >= 0, "backup-interval must not be negative")
+	check(c.BackupKeep >= 0, "backup-keep must not be negative")
+	check((c.TLSCert == "") == (c.TLSKey == ""), "tls-cert and tls-key must be set together")
+	check(c.TLSCert == "" || len(c.ACMEDomains) == 0, "tls-cert and acme-domains can't both be set")
+	check(len(c.ACMEDomains) == 0 || c.ACMEDirectory != "", "acme-directory must not be empty")
+	if c.HTTPPort != "" {
+		port, err := strconv.Atoi(c.HTTPPort)
+		check(err == nil && port > 0 && port < 65536, "http-port must be a number from 1 to 65535, not %q", c.HTTPPort)
+		check(c.tlsMode() != "", "http-port needs tls-cert or acme-domains")
+		check(c.HTTPPort != c.Port, "http-port must differ from port")
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration: %w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// connLimits returns the WebSocket parameters of client connections.
+func (c *Config) connLimits() ConnLimits {
+	return ConnLimits{WriteWait: c.WriteWait, PongWait: c.PongWait, MaxMessageSize: c.MaxMessageSize}
+}
+
+// print writes the configuration as a TOML file, with the database
+// password masked.
+func (c *Config) print(w io.Writer) error {
+	shown := *c
+	shown.DB = redactDSN(c.DB)
+	return toml.NewEncoder(w).Encode(&shown)
+}
+
+// redactDSN masks the password of a postgres URL, whether it is in the
+// userinfo or a password parameter. SQLite paths are returned unchanged.
+func redactDSN(dsn string) string {
+	if !isPostgresDSN(dsn) {
+		return dsn
+	}
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return strings.SplitN(dsn, "://", 2)[0] + "://(unparsable, hidden)"
+	}
+	if query := u.Query(); query.Has("password") {
+		query.Set("password", "xxxxx")
+		u.RawQuery = query.Encode()
+	}
+	return u.Redacted()
+}
+
+// runConfig implements the config command. "config print" shows the
+// settings the server would run with, given the same flags and environment.
+func runConfig(args []string) error {
+	if len(args) == 0 || args[0] != "print" {
+		return fmt.Errorf("usage: %s config print [flags]", os.Args[0])
+	}
+	c, err := loadConfig(flag.NewFlagSet("config print", flag.ExitOnError), args[1:])
+	if err != nil {
+		return err
+	}
+	return c.print(os.Stdout)
+}
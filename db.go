@@ -3,22 +3,30 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
 	"database/sql"
 	"encoding/hex"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"runtime"
+	"strings"
+	"time"
 
 	"golang.org/x/crypto/bcrypt"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
+// DB is the SQLite store. The embedded handle is the single writer; queries
+// go to reader, a read-only pool, so they don't queue behind inserts.
 type DB struct {
 	*sql.DB
+	reader *sql.DB
+	fts    bool // Whether the messages_fts full-text index is available
 }
 
 func SQLiteDbString(file string, readonly bool) string {
@@ -65,76 +73,225 @@ func InitDB(file string, readonly bool) (*DB, error) {
 	} else {
 		db.SetMaxOpenConns(1)
 	}
-	return &DB{db}, nil
+	return &DB{DB: db, reader: db}, nil
 
 }
 
-func (db *DB) CreateTables() error {
-	tables := []string{
-		`CREATE TABLE IF NOT EXISTS users (
-			username TEXT PRIMARY KEY,
-			hashed_password TEXT NOT NULL
-		)`,
-		`CREATE TABLE IF NOT EXISTS sessions (
-			token TEXT PRIMARY KEY,
-			username TEXT NOT NULL,
-			FOREIGN KEY (username) REFERENCES users(username)
-		)`,
-		`CREATE TABLE IF NOT EXISTS rooms (
-			id TEXT PRIMARY KEY
-		)`,
-		`CREATE TABLE IF NOT EXISTS messages (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			room_id TEXT NOT NULL,
-			username TEXT NOT NULL,
-			content TEXT NOT NULL,
-			timestamp TEXT NOT NULL,
-			FOREIGN KEY (room_id) REFERENCES rooms(id),
-			FOREIGN KEY (username) REFERENCES users(username)
+// PingContext checks that the database can be read. It uses the read
+// pool so that it doesn't queue behind writes.
+func (db *DB) PingContext(ctx context.Context) error {
+	return db.reader.PingContext(ctx)
+}
+
+// OpenDB opens a SQLite database with one writer connection and a
+// read-only pool for queries.
+func OpenDB(file string) (*DB, error) {
+	db, err := InitDB(file, false)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := InitDB(file, true)
+	if err != nil {
+		db.DB.Close()
+		return nil, err
+	}
+	db.reader = reader.DB
+	return db, nil
+}
+
+// Close closes the reader pool and the writer.
+func (db *DB) Close() error {
+	var err error
+	if db.reader != db.DB {
+		err = db.reader.Close()
+	}
+	return errors.Join(err, db.DB.Close())
+}
+
+// Checkpoint writes the WAL back into the main database file and truncates it.
+func (db *DB) Checkpoint() error {
+	_, err := db.Exec("PRAGMA wal_checkpoint(TRUNCATE)")
+	if err != nil {
+		return fmt.Errorf("error checkpointing database: %w", err)
+	}
+	return nil
+}
+
+// createSearchIndex sets up the messages_fts full-text index and the
+// triggers that keep it in sync with messages. FTS5 needs the sqlite_fts5
+// build tag; without it search falls back to substring matching.
+func (db *DB) createSearchIndex() error {
+	var exists, available int
+	err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE name = 'messages_fts'").Scan(&exists)
+	if err != nil {
+		return fmt.Errorf("error checking search index: %w", err)
+	}
+	err = db.QueryRow("SELECT COUNT(*) FROM pragma_compile_options WHERE compile_options = 'ENABLE_FTS5'").Scan(&available)
+	if err != nil {
+		return fmt.Errorf("error checking search index: %w", err)
+	}
+	if available == 0 {
+		if exists > 0 {
+			// The triggers on messages would fail every insert.
+			return fmt.Errorf("database has a full-text index but SQLite was built without FTS5, build with -tags sqlite_fts5")
+		}
+		slog.Warn("SQLite was built without FTS5, message search will be slow (build with -tags sqlite_fts5)")
+		return nil
+	}
+
+	statements := []string{
+		`CREATE VIRTUAL TABLE IF NOT EXISTS messages_fts USING fts5(
+			content,
+			content='messages',
+			content_rowid='id'
 		)`,
+		`CREATE TRIGGER IF NOT EXISTS messages_fts_insert AFTER INSERT ON messages BEGIN
+			INSERT INTO messages_fts(rowid, content) VALUES (new.id, new.content);
+		END`,
+		`CREATE TRIGGER IF NOT EXISTS messages_fts_delete AFTER DELETE ON messages BEGIN
+			INSERT INTO messages_fts(messages_fts, rowid, content) VALUES ('delete', old.id, old.content);
+		END`,
+		`CREATE TRIGGER IF NOT EXISTS messages_fts_update AFTER UPDATE OF content ON messages BEGIN
+			INSERT INTO messages_fts(messages_fts, rowid, content) VALUES ('delete', old.id, old.content);
+			INSERT INTO messages_fts(rowid, content) VALUES (new.id, new.content);
+		END`,
+	}
+	for _, statement := range statements {
+		if _, err := db.Exec(statement); err != nil {
+			return fmt.Errorf("error creating search index: %w", err)
+		}
 	}
 
-	for _, table := range tables {
-		_, err := db.Exec(table)
-		if err != nil {
-			return fmt.Errorf("error creating table: %w", err)
+	// Index messages stored before the index existed.
+	if exists == 0 {
+		if _, err := db.Exec("INSERT INTO messages_fts(messages_fts) VALUES ('rebuild')"); err != nil {
+			return fmt.Errorf("error building search index: %w", err)
 		}
 	}
 
+	db.fts = true
 	return nil
 }
 
-func (db *DB) GetUser(username string) (*User, error) {
+// userColumns are the users columns read by scanUser, in order.
+const userColumns = "username, hashed_password, is_admin, disabled"
+
+// scanUser reads a row of userColumns.
+func scanUser(row interface{ Scan(...any) error }) (*User, error) {
 	var user User
-	err := db.QueryRow("SELECT username, hashed_password FROM users WHERE username = ?", username).Scan(&user.Username, &user.HashedPassword)
+	if err := row.Scan(&user.Username, &user.HashedPassword, &user.IsAdmin, &user.Disabled); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// scanSessions reads rows of token, username and created_at.
+func scanSessions(rows *sql.Rows) ([]Session, error) {
+	defer rows.Close()
+	var sessions []Session
+	for rows.Next() {
+		var session Session
+		var createdAt sql.NullInt64
+		if err := rows.Scan(&session.Token, &session.Username, &createdAt); err != nil {
+			return nil, fmt.Errorf("error scanning session row: %w", err)
+		}
+		if createdAt.Valid {
+			session.CreatedAt = time.Unix(createdAt.Int64, 0)
+		}
+		sessions = append(sessions, session)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating session rows: %w", err)
+	}
+	return sessions, nil
+}
+
+func (db *DB) GetUser(ctx context.Context, username string) (*User, error) {
+	defer observeQuery(ctx, "GetUser")()
+	user, err := scanUser(db.reader.QueryRowContext(ctx, "SELECT "+userColumns+" FROM users WHERE username = ?", username))
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, nil
 		}
 		return nil, fmt.Errorf("error querying user: %w", err)
 	}
-	return &user, nil
+	return user, nil
 }
 
-func (db *DB) CreateUser(username, hashedPassword string) error {
-	_, err := db.Exec("INSERT INTO users (username, hashed_password) VALUES (?, ?)", username, hashedPassword)
+// ListUsers returns every user, disabled ones included.
+func (db *DB) ListUsers(ctx context.Context) ([]User, error) {
+	defer observeQuery(ctx, "ListUsers")()
+	rows, err := db.reader.QueryContext(ctx, "SELECT "+userColumns+" FROM users ORDER BY username")
+	if err != nil {
+		return nil, fmt.Errorf("error listing users: %w", err)
+	}
+	defer rows.Close()
+
+	var users []User
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning user row: %w", err)
+		}
+		users = append(users, *user)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating user rows: %w", err)
+	}
+	return users, nil
+}
+
+func (db *DB) CreateUser(ctx context.Context, username, hashedPassword string) error {
+	defer observeQuery(ctx, "CreateUser")()
+	_, err := db.ExecContext(ctx, "INSERT INTO users (username, hashed_password) VALUES (?, ?)", username, hashedPassword)
 	if err != nil {
 		return fmt.Errorf("error creating user: %w", err)
 	}
 	return nil
 }
 
-func (db *DB) CreateSession(token, username string) error {
-	_, err := db.Exec("INSERT INTO sessions (token, username) VALUES (?, ?)", token, username)
+func (db *DB) SetAdmin(ctx context.Context, username string, admin bool) error {
+	defer observeQuery(ctx, "SetAdmin")()
+	_, err := db.ExecContext(ctx, "UPDATE users SET is_admin = ? WHERE username = ?", admin, username)
+	if err != nil {
+		return fmt.Errorf("error updating user: %w", err)
+	}
+	return nil
+}
+
+// SetUserDisabled disables or re-enables a user. It doesn't touch their
+// sessions; DeleteUserSessions logs them out.
+func (db *DB) SetUserDisabled(ctx context.Context, username string, disabled bool) error {
+	defer observeQuery(ctx, "SetUserDisabled")()
+	_, err := db.ExecContext(ctx, "UPDATE users SET disabled = ? WHERE username = ?", disabled, username)
+	if err != nil {
+		return fmt.Errorf("error updating user: %w", err)
+	}
+	return nil
+}
+
+func (db *DB) SetPassword(ctx context.Context, username, hashedPassword string) error {
+	defer observeQuery(ctx, "SetPassword")()
+	_, err := db.ExecContext(ctx, "UPDATE users SET hashed_password = ? WHERE username = ?", hashedPassword, username)
+	if err != nil {
+		return fmt.Errorf("error updating password: %w", err)
+	}
+	return nil
+}
+
+func (db *DB) CreateSession(ctx context.Context, token, username string) error {
+	defer observeQuery(ctx, "CreateSession")()
+	_, err := db.ExecContext(ctx, "INSERT INTO sessions (token, username, created_at) VALUES (?, ?, ?)", token, username, time.Now().Unix())
 	if err != nil {
 		return fmt.Errorf("error creating session: %w", err)
 	}
 	return nil
 }
 
-func (db *DB) GetUserFromSession(token string) (*User, error) {
+func (db *DB) GetUserFromSession(ctx context.Context, token string) (*User, error) {
+	defer observeQuery(ctx, "GetUserFromSession")()
 	var username string
-	err := db.QueryRow("SELECT username FROM sessions WHERE token = ?", token).Scan(&username)
+	err := db.reader.QueryRowContext(ctx, "SELECT username FROM sessions WHERE token = ?", token).Scan(&username)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, nil
@@ -142,28 +299,215 @@ func (db *DB) GetUserFromSession(token string) (*User, error) {
 		return nil, fmt.Errorf("error querying session: %w", err)
 	}
 
-	return db.GetUser(username)
+	return db.GetUser(ctx, username)
+}
+
+// ListSessions returns every session, newest first.
+func (db *DB) ListSessions(ctx context.Context) ([]Session, error) {
+	defer observeQuery(ctx, "ListSessions")()
+	rows, err := db.reader.QueryContext(ctx, "SELECT token, username, created_at FROM sessions ORDER BY created_at DESC, username")
+	if err != nil {
+		return nil, fmt.Errorf("error listing sessions: %w", err)
+	}
+	return scanSessions(rows)
+}
+
+// DeleteSession logs a session out.
+func (db *DB) DeleteSession(ctx context.Context, token string) error {
+	defer observeQuery(ctx, "DeleteSession")()
+	_, err := db.ExecContext(ctx, "DELETE FROM sessions WHERE token = ?", token)
+	if err != nil {
+		return fmt.Errorf("error deleting session: %w", err)
+	}
+	return nil
 }
 
-func (db *DB) CreateRoom(roomID string) error {
-	_, err := db.Exec("INSERT OR IGNORE INTO rooms (id) VALUES (?)", roomID)
+// DeleteUserSessions logs a user out everywhere.
+func (db *DB) DeleteUserSessions(ctx context.Context, username string) error {
+	defer observeQuery(ctx, "DeleteUserSessions")()
+	_, err := db.ExecContext(ctx, "DELETE FROM sessions WHERE username = ?", username)
+	if err != nil {
+		return fmt.Errorf("error deleting sessions: %w", err)
+	}
+	return nil
+}
+
+// CreateRoom creates a room owned by the given user. Existing rooms are left untouched.
+func (db *DB) CreateRoom(ctx context.Context, roomID, owner string) error {
+	defer observeQuery(ctx, "CreateRoom")()
+	_, err := db.ExecContext(ctx, "INSERT OR IGNORE INTO rooms (id, owner) VALUES (?, ?)", roomID, owner)
 	if err != nil {
 		return fmt.Errorf("error creating room: %w", err)
 	}
 	return nil
 }
 
-func (db *DB) StoreMessage(roomID, username, content, timestamp string) error {
-	_, err := db.Exec("INSERT INTO messages (room_id, username, content, timestamp) VALUES (?, ?, ?, ?)",
-		roomID, username, content, timestamp)
+// roomColumns are the rooms columns read by scanRoom, in order.
+const roomColumns = "id, owner, archived, slow_mode, retain_days, retain_messages, legal_hold"
+
+// scanRoom reads a row of roomColumns.
+func scanRoom(row interface{ Scan(...any) error }) (*Room, error) {
+	var room Room
+	var owner sql.NullString
+	err := row.Scan(&room.ID, &owner, &room.Archived, &room.SlowMode, &room.RetainDays, &room.RetainMessages, &room.LegalHold)
+	if err != nil {
+		return nil, err
+	}
+	room.Owner = owner.String
+	return &room, nil
+}
+
+func (db *DB) GetRoom(ctx context.Context, roomID string) (*Room, error) {
+	defer observeQuery(ctx, "GetRoom")()
+	room, err := scanRoom(db.reader.QueryRowContext(ctx, "SELECT "+roomColumns+" FROM rooms WHERE id = ?", roomID))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error querying room: %w", err)
+	}
+	return room, nil
+}
+
+// ListRooms returns every room, archived ones included.
+func (db *DB) ListRooms(ctx context.Context) ([]Room, error) {
+	defer observeQuery(ctx, "ListRooms")()
+	rows, err := db.reader.QueryContext(ctx, "SELECT "+roomColumns+" FROM rooms ORDER BY id")
+	if err != nil {
+		return nil, fmt.Errorf("error listing rooms: %w", err)
+	}
+	defer rows.Close()
+
+	var rooms []Room
+	for rows.Next() {
+		room, err := scanRoom(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning room row: %w", err)
+		}
+		rooms = append(rooms, *room)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating room rows: %w", err)
+	}
+	return rooms, nil
+}
+
+func (db *DB) SetRoomArchived(ctx context.Context, roomID string, archived bool) error {
+	defer observeQuery(ctx, "SetRoomArchived")()
+	_, err := db.ExecContext(ctx, "UPDATE rooms SET archived = ? WHERE id = ?", archived, roomID)
+	if err != nil {
+		return fmt.Errorf("error archiving room: %w", err)
+	}
+	return nil
+}
+
+// SetRoomSlowMode sets the minimum number of seconds between messages from one user.
+func (db *DB) SetRoomSlowMode(ctx context.Context, roomID string, seconds int) error {
+	defer observeQuery(ctx, "SetRoomSlowMode")()
+	_, err := db.ExecContext(ctx, "UPDATE rooms SET slow_mode = ? WHERE id = ?", seconds, roomID)
+	if err != nil {
+		return fmt.Errorf("error setting slow mode: %w", err)
+	}
+	return nil
+}
+
+// SetRoomRetention overrides the retention of a room. Zero uses the server-wide setting.
+func (db *DB) SetRoomRetention(ctx context.Context, roomID string, days, messages int) error {
+	defer observeQuery(ctx, "SetRoomRetention")()
+	_, err := db.ExecContext(ctx, "UPDATE rooms SET retain_days = ?, retain_messages = ? WHERE id = ?", days, messages, roomID)
+	if err != nil {
+		return fmt.Errorf("error setting retention: %w", err)
+	}
+	return nil
+}
+
+// SetRoomLegalHold suspends or resumes pruning of a room's messages.
+func (db *DB) SetRoomLegalHold(ctx context.Context, roomID string, hold bool) error {
+	defer observeQuery(ctx, "SetRoomLegalHold")()
+	_, err := db.ExecContext(ctx, "UPDATE rooms SET legal_hold = ? WHERE id = ?", hold, roomID)
+	if err != nil {
+		return fmt.Errorf("error setting legal hold: %w", err)
+	}
+	return nil
+}
+
+// DeleteRoom removes a room together with all of its messages.
+func (db *DB) DeleteRoom(ctx context.Context, roomID string) error {
+	defer observeQuery(ctx, "DeleteRoom")()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error deleting room: %w", err)
+	}
+	defer tx.Rollback()
+
+	// A hold placed since the caller looked at the room still stops the delete.
+	if _, err := tx.ExecContext(ctx, "DELETE FROM messages WHERE room_id = ? AND EXISTS (SELECT 1 FROM rooms WHERE id = ? AND legal_hold = 0)", roomID, roomID); err != nil {
+		return fmt.Errorf("error deleting room messages: %w", err)
+	}
+	result, err := tx.ExecContext(ctx, "DELETE FROM rooms WHERE id = ? AND legal_hold = 0", roomID)
 	if err != nil {
-		return fmt.Errorf("error storing message: %w", err)
+		return fmt.Errorf("error deleting room: %w", err)
+	}
+	if deleted, err := result.RowsAffected(); err != nil {
+		return fmt.Errorf("error deleting room: %w", err)
+	} else if deleted == 0 {
+		return errLegalHold
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error deleting room: %w", err)
 	}
 	return nil
 }
 
-func (db *DB) GetRoomMessages(roomID string) ([]Message, error) {
-	rows, err := db.Query("SELECT content, username, timestamp, rowid FROM messages WHERE room_id = ? ORDER BY rowid", roomID)
+func (db *DB) StoreMessage(ctx context.Context, roomID, username, content, timestamp string) error {
+	_, err := db.StoreMessages(ctx, []PendingMessage{{roomID, "message", username, content, timestamp}})
+	return err
+}
+
+// StoreMessages stores messages in one transaction and returns their row IDs.
+// Either all of them are stored or none is.
+func (db *DB) StoreMessages(ctx context.Context, messages []PendingMessage) ([]int64, error) {
+	defer observeQuery(ctx, "StoreMessages")()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error storing messages: %w", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, "INSERT INTO messages (room_id, type, username, content, timestamp, created_at) VALUES (?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		return nil, fmt.Errorf("error storing messages: %w", err)
+	}
+	defer stmt.Close()
+
+	ids := make([]int64, len(messages))
+	for i, m := range messages {
+		result, err := stmt.ExecContext(ctx, m.RoomID, m.Type, m.Username, m.Content, m.Timestamp, messageTime(m.Timestamp).Unix())
+		if err != nil {
+			return nil, fmt.Errorf("error storing message: %w", err)
+		}
+		if ids[i], err = result.LastInsertId(); err != nil {
+			return nil, fmt.Errorf("error storing message: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("error storing messages: %w", err)
+	}
+	return ids, nil
+}
+
+func (db *DB) GetRoomMessages(ctx context.Context, roomID string, limit int) ([]Message, error) {
+	defer observeQuery(ctx, "GetRoomMessages")()
+	if limit <= 0 {
+		limit = -1 // No limit in SQLite
+	}
+	rows, err := db.reader.QueryContext(ctx, `
+        SELECT type, content, username, timestamp, id FROM (
+            SELECT type, content, username, timestamp, id, created_at FROM messages
+            WHERE room_id = ?
+            ORDER BY created_at DESC, id DESC
+            LIMIT ?
+        ) ORDER BY created_at, id`, roomID, limit)
 	if err != nil {
 		return nil, fmt.Errorf("error fetching room messages: %w", err)
 	}
@@ -172,11 +516,10 @@ func (db *DB) GetRoomMessages(roomID string) ([]Message, error) {
 	var messages []Message
 	for rows.Next() {
 		var msg Message
-		err := rows.Scan(&msg.Content, &msg.User, &msg.Timestamp, &msg.RowId)
+		err := rows.Scan(&msg.Type, &msg.Content, &msg.User, &msg.Timestamp, &msg.RowId)
 		if err != nil {
 			return nil, fmt.Errorf("error scanning message row: %w", err)
 		}
-		msg.Type = "message"
 		messages = append(messages, msg)
 	}
 
@@ -187,11 +530,144 @@ func (db *DB) GetRoomMessages(roomID string) ([]Message, error) {
 	return messages, nil
 }
 
-func (db *DB) GetRooms() (map[string]int, error) {
-	rows, err := db.Query(`
+// SearchMessages returns the messages matching a search, newest first.
+func (db *DB) SearchMessages(ctx context.Context, q SearchQuery) ([]SearchResult, error) {
+	defer observeQuery(ctx, "SearchMessages")()
+	var where []string
+	var args []any
+
+	if db.fts && strings.TrimSpace(q.Text) != "" {
+		where = append(where, "m.id IN (SELECT rowid FROM messages_fts WHERE messages_fts MATCH ?)")
+		args = append(args, ftsQuery(q.Text))
+	} else if !db.fts {
+		for _, term := range strings.Fields(q.Text) {
+			where = append(where, "m.content LIKE ? ESCAPE '\\'")
+			args = append(args, "%"+likeEscaper.Replace(term)+"%")
+		}
+	}
+	if q.RoomID != "" {
+		where = append(where, "m.room_id = ?")
+		args = append(args, q.RoomID)
+	}
+	if q.Username != "" {
+		where = append(where, "m.username = ?")
+		args = append(args, q.Username)
+	}
+	if !q.From.IsZero() {
+		where = append(where, "m.created_at >= ?")
+		args = append(args, q.From.Unix())
+	}
+	if !q.To.IsZero() {
+		where = append(where, "m.created_at < ?")
+		args = append(args, q.To.Unix())
+	}
+	if len(where) == 0 {
+		return nil, nil
+	}
+	// Join and leave events are stored with the messages but aren't searchable.
+	where = append(where, "m.type = 'message'")
+	args = append(args, q.Limit)
+
+	// Every room is public, so any message still attached to a room is
+	// visible; messages of deleted rooms are gone with them.
+	rows, err := db.reader.QueryContext(ctx, `
+        SELECT m.room_id, m.content, m.username, m.timestamp, m.id
+        FROM messages m
+        JOIN rooms r ON r.id = m.room_id
+        WHERE `+strings.Join(where, " AND ")+`
+        ORDER BY m.created_at DESC, m.id DESC
+        LIMIT ?`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error searching messages: %w", err)
+	}
+	defer rows.Close()
+
+	var results []SearchResult
+	for rows.Next() {
+		var result SearchResult
+		err := rows.Scan(&result.RoomID, &result.Content, &result.User, &result.Timestamp, &result.RowId)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning search result: %w", err)
+		}
+		result.Type = "message"
+		results = append(results, result)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating search results: %w", err)
+	}
+	return results, nil
+}
+
+// PruneMessages deletes up to limit of a room's oldest messages that were
+// created before the given time or fall outside the newest keep.
+func (db *DB) PruneMessages(ctx context.Context, roomID string, before time.Time, keep, limit int) (int, error) {
+	defer observeQuery(ctx, "PruneMessages")()
+	var where []string
+	args := []any{roomID}
+	if !before.IsZero() {
+		where = append(where, "created_at < ?")
+		args = append(args, before.Unix())
+	}
+	if keep > 0 {
+		// The newest message that doesn't fit in keep, and everything before it.
+		var cutoffTime sql.NullInt64
+		var cutoff int64
+		err := db.QueryRowContext(ctx, "SELECT created_at, id FROM messages WHERE room_id = ? ORDER BY created_at DESC, id DESC LIMIT 1 OFFSET ?", roomID, keep).Scan(&cutoffTime, &cutoff)
+		if err != nil && err != sql.ErrNoRows {
+			return 0, fmt.Errorf("error pruning messages: %w", err)
+		}
+		if err == nil && cutoffTime.Valid {
+			where = append(where, "created_at IS NULL OR created_at < ? OR created_at = ? AND id <= ?")
+			args = append(args, cutoffTime.Int64, cutoffTime.Int64, cutoff)
+		} else if err == nil {
+			// Messages without a creation time sort first.
+			where = append(where, "created_at IS NULL AND id <= ?")
+			args = append(args, cutoff)
+		}
+	}
+	if len(where) == 0 {
+		return 0, nil
+	}
+	args = append(args, limit)
+
+	result, err := db.ExecContext(ctx, `
+        DELETE FROM messages WHERE id IN (
+            SELECT id FROM messages
+            WHERE room_id = ? AND (`+strings.Join(where, " OR ")+`)
+                AND NOT EXISTS (SELECT 1 FROM rooms WHERE id = messages.room_id AND legal_hold = 1)
+            ORDER BY created_at, id
+            LIMIT ?
+        )`, args...)
+	if err != nil {
+		return 0, fmt.Errorf("error pruning messages: %w", err)
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("error pruning messages: %w", err)
+	}
+	return int(deleted), nil
+}
+
+// likeEscaper escapes LIKE wildcards in user input.
+var likeEscaper = strings.NewReplacer("\\", "\\\\", "%", "\\%", "_", "\\_")
+
+// ftsQuery turns free text into an FTS5 query matching every word,
+// quoting each so that FTS5 operators in the input are taken literally.
+func ftsQuery(text string) string {
+	terms := strings.Fields(text)
+	for i, term := range terms {
+		terms[i] = `"` + strings.ReplaceAll(term, `"`, `""`) + `"`
+	}
+	return strings.Join(terms, " ")
+}
+
+func (db *DB) GetRooms(ctx context.Context) (map[string]int, error) {
+	defer observeQuery(ctx, "GetRooms")()
+	rows, err := db.reader.QueryContext(ctx, `
         SELECT r.id, COUNT(DISTINCT m.username) as user_count
         FROM rooms r
         LEFT JOIN messages m ON r.id = m.room_id
+        WHERE r.archived = 0
         GROUP BY r.id
     `)
 	if err != nil {
@@ -211,9 +687,10 @@ func (db *DB) GetRooms() (map[string]int, error) {
 	return rooms, nil
 }
 
-func (db *DB) GetUserCount() (int, error) {
+func (db *DB) GetUserCount(ctx context.Context) (int, error) {
+	defer observeQuery(ctx, "GetUserCount")()
 	var count int
-	err := db.QueryRow("SELECT COUNT(*) FROM users").Scan(&count)
+	err := db.reader.QueryRowContext(ctx, "SELECT COUNT(*) FROM users").Scan(&count)
 	return count, err
 }
 
@@ -221,7 +698,7 @@ func (db *DB) GetUserCount() (int, error) {
 func generateSessionToken() string {
 	bytes := make([]byte, 32)
 	if _, err := rand.Read(bytes); err != nil {
-		log.Fatal(err)
+		panic(err)
 	}
 	return hex.EncodeToString(bytes)
 }
@@ -236,22 +713,24 @@ func getUserFromSession(rm *RoomManager, r *http.Request) *User {
 	rm.mu.Lock()
 	defer rm.mu.Unlock()
 
-	user, err := rm.db.GetUserFromSession(cookie.Value)
+	user, err := rm.db.GetUserFromSession(r.Context(), cookie.Value)
 	if err != nil {
-		log.Printf("Error getting user from session: %v", err)
+		loggerFrom(r.Context()).Error("Error getting user from session", "err", err)
 		return nil
 	}
 
-	if user != nil {
-		user.SessionToken = cookie.Value
+	// Disabled users are logged out, even if a session slipped through.
+	if user == nil || user.Disabled {
+		return nil
 	}
+	user.SessionToken = cookie.Value
 
 	return user
 }
 
-// Hash Password
-func hashPassword(password string) (string, error) {
-	hashedBytes, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+// Hash Password with the given bcrypt cost
+func hashPassword(password string, cost int) (string, error) {
+	hashedBytes, err := bcrypt.GenerateFromPassword([]byte(password), cost)
 	if err != nil {
 		return "", err
 	}
@@ -263,3 +742,77 @@ func verifyPassword(hashedPassword, password string) bool {
 	err := bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(password))
 	return err == nil
 }
+
+// ExportMessages calls fn for each of a room's messages created in [from, to), oldest first.
+func (db *DB) ExportMessages(ctx context.Context, roomID string, from, to time.Time, fn func(StoredMessage) error) error {
+	defer observeQuery(ctx, "ExportMessages")()
+	where := "room_id = ?"
+	args := []any{roomID}
+	if !from.IsZero() {
+		args = append(args, from.Unix())
+		where += " AND created_at >= ?"
+	}
+	if !to.IsZero() {
+		args = append(args, to.Unix())
+		where += " AND created_at < ?"
+	}
+	rows, err := db.reader.QueryContext(ctx, "SELECT id, type, username, content, timestamp, created_at FROM messages WHERE "+where+" ORDER BY created_at, id", args...)
+	if err != nil {
+		return fmt.Errorf("error exporting messages: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		m := StoredMessage{RoomID: roomID}
+		var createdAt sql.NullInt64
+		if err := rows.Scan(&m.ID, &m.Type, &m.User, &m.Content, &m.Timestamp, &createdAt); err != nil {
+			return fmt.Errorf("error scanning message row: %w", err)
+		}
+		if createdAt.Valid {
+			m.CreatedAt = time.Unix(createdAt.Int64, 0).UTC()
+		}
+		if err := fn(m); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating message rows: %w", err)
+	}
+	return nil
+}
+
+// ImportMessages stores imported messages in one transaction, skipping those already imported.
+func (db *DB) ImportMessages(ctx context.Context, messages []ImportedMessage) (int, error) {
+	defer observeQuery(ctx, "ImportMessages")()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("error importing messages: %w", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, `
+        INSERT INTO messages (room_id, type, username, content, timestamp, created_at, import_key)
+        VALUES (?, ?, ?, ?, ?, ?, ?)
+        ON CONFLICT DO NOTHING`)
+	if err != nil {
+		return 0, fmt.Errorf("error importing messages: %w", err)
+	}
+	defer stmt.Close()
+
+	imported := 0
+	for _, m := range messages {
+		result, err := stmt.ExecContext(ctx, m.RoomID, m.Type, m.Username, m.Content, m.Timestamp, m.CreatedAt.Unix(), m.Key)
+		if err != nil {
+			return 0, fmt.Errorf("error importing message: %w", err)
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return 0, fmt.Errorf("error importing message: %w", err)
+		}
+		imported += int(n)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("error importing messages: %w", err)
+	}
+	return imported, nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// BenchmarkHistoryUnderWrites loads a room's history, as every join does,
+// while other goroutines keep inserting messages into another room the way
+// the load test's clients do. With one shared connection each read waits for the inserts
+// queued ahead of it; the split reader pool doesn't.
+func BenchmarkHistoryUnderWrites(b *testing.B) {
+	open := map[string]func(file string) (*DB, error){
+		"shared": func(file string) (*DB, error) { return InitDB(file, false) },
+		"split":  OpenDB,
+	}
+	for _, name := range []string{"shared", "split"} {
+		b.Run(name, func(b *testing.B) {
+			db, err := open[name](filepath.Join(b.TempDir(), "chat.db"))
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer db.Close()
+			if err := db.Migrate(); err != nil {
+				b.Fatal(err)
+			}
+			benchmarkHistoryUnderWrites(b, db)
+		})
+	}
+}
+
+func benchmarkHistoryUnderWrites(b *testing.B, db *DB) {
+	ctx := context.Background()
+	if err := db.CreateUser(ctx, "alice", "x"); err != nil {
+		b.Fatal(err)
+	}
+	for _, room := range []string{"lobby", "busy"} {
+		if err := db.CreateRoom(ctx, room, "alice"); err != nil {
+			b.Fatal(err)
+		}
+	}
+	for i := 0; i < 200; i++ {
+		if err := db.StoreMessage(ctx, "lobby", "alice", fmt.Sprintf("message %d", i), "12:00"); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	// Roughly the message rate of the load test at full tilt.
+	const writers, writeInterval = 8, 2 * time.Millisecond
+	var stop atomic.Bool
+	var writes atomic.Int64
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for !stop.Load() {
+				if err := db.StoreMessage(ctx, "busy", "alice", "hello", "12:00"); err != nil {
+					b.Error(err)
+					return
+				}
+				writes.Add(1)
+				time.Sleep(writeInterval)
+			}
+		}()
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := db.GetRoomMessages(ctx, "lobby", 0); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+	b.StopTimer()
+	stop.Store(true)
+	wg.Wait()
+	b.ReportMetric(float64(writes.Load())/b.Elapsed().Seconds(), "writes/s")
+}
@@ -0,0 +1,254 @@
+// export.go
+
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// StoredMessage is a message as kept in the store, with the details
+// exports need.
+type StoredMessage struct {
+	ID        int64
+	RoomID    string
+	Type      string    // "message", or "join"/"leave" for system messages
+	User      string
+	Content   string
+	Timestamp string    // In timestampFormat, or a local time for messages the migration couldn't read
+	CreatedAt time.Time // Zero for messages stored before creation times were recorded
+}
+
+// exportFormats maps the supported formats to their content types.
+var exportFormats = map[string]string{
+	"jsonl": "application/jsonl; charset=utf-8",
+	"csv":   "text/csv; charset=utf-8",
+	"html":  "text/html; charset=utf-8",
+}
+
+// exportWriter writes an export one message at a time.
+type exportWriter interface {
+	write(m StoredMessage) error
+	close() error // Writes anything the format needs after the last message
+}
+
+// newExportWriter starts an export of roomID in the given format.
+func newExportWriter(w io.Writer, format, roomID string) (exportWriter, error) {
+	switch format {
+	case "jsonl":
+		return &jsonlExport{enc: json.NewEncoder(w)}, nil
+	case "csv":
+		e := &csvExport{w: csv.NewWriter(w)}
+		return e, e.w.Write([]string{"id", "type", "user", "content", "timestamp", "created_at"})
+	case "html":
+		e := &htmlExport{w: w}
+		return e, exportTemplate.ExecuteTemplate(w, "header", struct {
+			Room     string
+			Exported time.Time
+		}{roomID, time.Now().UTC()})
+	}
+	return nil, fmt.Errorf("unknown export format %q", format)
+}
+
+// createdAt formats a creation time for exports, empty when unknown.
+func createdAt(m StoredMessage) string {
+	if m.CreatedAt.IsZero() {
+		return ""
+	}
+	return m.CreatedAt.Format(time.RFC3339)
+}
+
+// jsonlExport writes one JSON object per line.
+type jsonlExport struct {
+	enc *json.Encoder
+}
+
+func (e *jsonlExport) write(m StoredMessage) error {
+	return e.enc.Encode(struct {
+		ID        int64  `json:"id"`
+		Room      string `json:"room"`
+		Type      string `json:"type"`
+		User      string `json:"user"`
+		Content   string `json:"content"`
+		Timestamp string `json:"timestamp"`
+		CreatedAt string `json:"created_at,omitempty"`
+	}{m.ID, m.RoomID, m.Type, m.User, m.Content, m.Timestamp, createdAt(m)})
+}
+
+func (e *jsonlExport) close() error {
+	return nil
+}
+
+// csvExport writes a header row and one row per message.
+type csvExport struct {
+	w *csv.Writer
+}
+
+func (e *csvExport) write(m StoredMessage) error {
+	return e.w.Write([]string{strconv.FormatInt(m.ID, 10), m.Type, m.User, m.Content, m.Timestamp, createdAt(m)})
+}
+
+func (e *csvExport) close() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+// htmlExport writes a standalone transcript page.
+type htmlExport struct {
+	w io.Writer
+}
+
+func (e *htmlExport) write(m StoredMessage) error {
+	return exportTemplate.ExecuteTemplate(e.w, "message", m)
+}
+
+func (e *htmlExport) close() error {
+	return exportTemplate.ExecuteTemplate(e.w, "footer", nil)
+}
+
+// exportTemplate renders HTML transcripts. It has no external assets so
+// the file stays readable on its own.
+var exportTemplate = template.Must(template.New("export").Parse(`
+{{- define "header" -}}
+<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="UTF-8">
+    <title>SupChat - {{ .Room }}</title>
+    <style>
+        body { font-family: sans-serif; max-width: 60em; margin: 2em auto; }
+        .msg { margin: 0.3em 0; }
+        .content { white-space: pre-wrap; }
+        .system { color: #777; font-style: italic; }
+        .time { color: #999; font-size: 0.85em; }
+    </style>
+</head>
+<body>
+    <h1>{{ .Room }}</h1>
+    <p class="time">Exported {{ .Exported.Format "2006-01-02 15:04:05 MST" }}</p>
+{{ end -}}
+{{- define "message" }}
+    <div class="msg{{ if ne .Type "message" }} system{{ end }}" id="msg-{{ .ID }}">
+        <span class="time" title="{{ .Timestamp }}">[{{ if .CreatedAt.IsZero }}{{ .Timestamp }}{{ else }}{{ .CreatedAt.Format "2006-01-02 15:04 MST" }}{{ end }}]</span>
+        {{ if eq .Type "message" }}<b>@{{ .User }}:</b>{{ else }}@{{ .User }}{{ end }} <span class="content">{{ .Content }}</span>
+    </div>
+{{- end -}}
+{{- define "footer" }}
+</body>
+</html>
+{{ end -}}
+`))
+
+// exportRoom writes a room's messages created in [from, to) to w.
+// Messages removed by retention or room deletion are gone and not exported.
+func exportRoom(ctx context.Context, store Store, w io.Writer, format, roomID string, from, to time.Time) error {
+	e, err := newExportWriter(w, format, roomID)
+	if err != nil {
+		return err
+	}
+	if err := store.ExportMessages(ctx, roomID, from, to, e.write); err != nil {
+		return err
+	}
+	return e.close()
+}
+
+//
+// Serves a download of a room's history
+//
+func serveExport(rm *RoomManager, w http.ResponseWriter, r *http.Request) {
+	if getUserFromSession(rm, r) == nil {
+		http.Error(w, "Login required", http.StatusUnauthorized)
+		return
+	}
+
+	roomID := r.PathValue("chatRoom")
+	room, err := rm.db.GetRoom(r.Context(), roomID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if room == nil {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return
+	}
+
+	format := r.FormValue("format")
+	if format == "" {
+		format = "jsonl"
+	}
+	contentType, ok := exportFormats[format]
+	if !ok {
+		http.Error(w, "Format must be jsonl, csv or html", http.StatusBadRequest)
+		return
+	}
+	from, to, err := parseDateRange(r.FormValue("from"), r.FormValue("to"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": roomID + "." + format}))
+	if err := exportRoom(r.Context(), rm.db, w, format, roomID, from, to); err != nil {
+		// The response has started, so all we can do is cut it short.
+		loggerFrom(r.Context()).Error("Error exporting room", "room", roomID, "err", err)
+	}
+}
+
+// runExport implements the export command, writing a room's history to
+// a file or standard output.
+func runExport(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	format := flags.String("format", "jsonl", "output format: jsonl, csv or html")
+	from := flags.String("from", "", "only messages sent on or after this date (YYYY-MM-DD)")
+	to := flags.String("to", "", "only messages sent on or before this date (YYYY-MM-DD)")
+	output := flags.String("o", "", "write to this file instead of standard output")
+	c, err := parseCommand(flags, "ROOM", args, 1)
+	if err != nil {
+		return err
+	}
+	roomID := flags.Arg(0)
+
+	if _, ok := exportFormats[*format]; !ok {
+		return fmt.Errorf("unknown export format %q", *format)
+	}
+	start, end, err := parseDateRange(*from, *to)
+	if err != nil {
+		return err
+	}
+
+	store, err := dialCurrentStore(c.DB)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	room, err := store.GetRoom(context.Background(), roomID)
+	if err != nil {
+		return err
+	}
+	if room == nil {
+		return fmt.Errorf("room %q not found", roomID)
+	}
+
+	out := os.Stdout
+	if *output != "" {
+		if out, err = os.Create(*output); err != nil {
+			return err
+		}
+	}
+	if err := exportRoom(context.Background(), store, out, *format, roomID, start, end); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
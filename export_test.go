@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExportFormats(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemStore()
+	store.CreateUser(ctx, "alice", "hash")
+	store.CreateRoom(ctx, "lobby", "alice")
+	store.StoreMessages(ctx, []PendingMessage{
+		{"lobby", "join", "alice", "has joined the chat", "Monday 3:04PM"},
+		{"lobby", "message", "alice", "<b>hi</b>, \"all\"\nsecond line", "Monday 3:05PM"},
+	})
+
+	want := map[string][]string{
+		"jsonl": {`"type":"join"`, `"content":"\u003cb\u003ehi\u003c/b\u003e, \"all\"\nsecond line"`},
+		"csv":   {"id,type,user,content,timestamp,created_at\n", "\"<b>hi</b>, \"\"all\"\"\nsecond line\""},
+		"html":  {`class="msg system"`, "&lt;b&gt;hi&lt;/b&gt;", "</html>"},
+	}
+	for format, parts := range want {
+		var out bytes.Buffer
+		if err := exportRoom(ctx, store, &out, format, "lobby", time.Time{}, time.Time{}); err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		for _, part := range parts {
+			if !strings.Contains(out.String(), part) {
+				t.Errorf("%s export lacks %q:\n%s", format, part, out.String())
+			}
+		}
+	}
+
+	// A range that ends before the messages were sent exports nothing.
+	var out bytes.Buffer
+	exportRoom(ctx, store, &out, "jsonl", "lobby", time.Time{}, time.Now().Add(-time.Hour))
+	if out.Len() != 0 {
+		t.Errorf("export outside the range: %s", out.String())
+	}
+}
+
+func TestExportFileName(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemStore()
+	store.CreateUser(ctx, "alice", "hash")
+	store.CreateSession(ctx, "token", "alice")
+	rm := &RoomManager{db: store}
+
+	// Room names go into the header as parameters, quoted or encoded as needed.
+	for _, roomID := range []string{"lobby", `say "hi"`, "café"} {
+		store.CreateRoom(ctx, roomID, "alice")
+		r := httptest.NewRequest("GET", "/c/x/export?format=csv", nil)
+		r.SetPathValue("chatRoom", roomID)
+		r.AddCookie(&http.Cookie{Name: "SessionToken", Value: "token"})
+		w := httptest.NewRecorder()
+		serveExport(rm, w, r)
+
+		disposition, params, err := mime.ParseMediaType(w.Header().Get("Content-Disposition"))
+		if err != nil || disposition != "attachment" || params["filename"] != roomID+".csv" {
+			t.Errorf("%q: Content-Disposition %q parses as %q %q, %v", roomID, w.Header().Get("Content-Disposition"), disposition, params, err)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+// health.go
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// readyTimeout bounds the database checks of a readiness probe.
+const readyTimeout = 2 * time.Second
+
+// errDraining is the readiness failure once shutdown has begun.
+var errDraining = errors.New("server is shutting down")
+
+// ready returns why the server shouldn't be sent new traffic, or nil if it
+// should: the database must be reachable and fully migrated, and the
+// server must not be shutting down.
+//
+// Checking migrations goes through SQLite's single writer connection, where
+// it would queue behind the persister, so it stops once the schema has been
+// seen to be current. Migrations only run at startup, so it stays current.
+func (rm *RoomManager) ready(ctx context.Context) error {
+	if rm.draining.Load() {
+		return errDraining
+	}
+	if p, ok := rm.db.(Pinger); ok {
+		if err := p.PingContext(ctx); err != nil {
+			return fmt.Errorf("database unreachable: %w", err)
+		}
+	}
+	if m, ok := rm.db.(Migrator); ok && !rm.schemaCurrent.Load() {
+		pending, err := m.PendingMigrations()
+		if err != nil {
+			return fmt.Errorf("error checking migrations: %w", err)
+		}
+		if len(pending) > 0 {
+			return fmt.Errorf("%d schema migrations pending", len(pending))
+		}
+		rm.schemaCurrent.Store(true)
+	}
+	return nil
+}
+
+//
+// Serves the liveness probe, which succeeds while the process can answer
+//
+func serveHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	fmt.Fprintln(w, "ok")
+}
+
+//
+// Serves the readiness probe, which fails while the server shouldn't be
+// sent new connections
+//
+func serveReadyz(rm *RoomManager, w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+	defer cancel()
+
+	w.Header().Set("Cache-Control", "no-store")
+	if err := rm.ready(ctx); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
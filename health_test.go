@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// probe returns the status and body of a readiness probe.
+func probe(rm *RoomManager) (int, string) {
+	w := httptest.NewRecorder()
+	serveReadyz(rm, w, httptest.NewRequest("GET", "/readyz", nil))
+	return w.Code, w.Body.String()
+}
+
+func TestReadyz(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "chat.db")
+	db, err := OpenDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	rm := &RoomManager{db: db}
+
+	if code, body := probe(rm); code != http.StatusServiceUnavailable || !strings.Contains(body, "migrations pending") {
+		t.Errorf("unmigrated database: %d %q", code, body)
+	}
+
+	if err := db.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if code, body := probe(rm); code != http.StatusOK {
+		t.Errorf("migrated database: %d %q", code, body)
+	}
+
+	// Once the schema is known to be current, probes don't wait for the
+	// writer connection, which a long write holds here.
+	tx, err := db.BeginTx(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code, body := probe(rm); code != http.StatusOK {
+		t.Errorf("busy writer: %d %q", code, body)
+	}
+	tx.Rollback()
+
+	rm.draining.Store(true)
+	if code, body := probe(rm); code != http.StatusServiceUnavailable || !strings.Contains(body, "shutting down") {
+		t.Errorf("draining: %d %q", code, body)
+	}
+
+	// Liveness doesn't depend on any of it.
+	w := httptest.NewRecorder()
+	serveHealthz(w, httptest.NewRequest("GET", "/healthz", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("healthz while draining: %d", w.Code)
+	}
+
+	rm.draining.Store(false)
+	db.Close()
+	if code, body := probe(rm); code != http.StatusServiceUnavailable || !strings.Contains(body, "unreachable") {
+		t.Errorf("closed database: %d %q", code, body)
+	}
+}
+
+func TestDrainingRefusesWebSockets(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemStore()
+	store.CreateUser(ctx, "alice", "hash")
+	store.CreateSession(ctx, "token", "alice")
+	rm := &RoomManager{db: store}
+	rm.draining.Store(true)
+
+	r := httptest.NewRequest("GET", "/ws/lobby", nil)
+	r.SetPathValue("chatRoom", "lobby")
+	r.AddCookie(&http.Cookie{Name: "SessionToken", Value: "token"})
+	w := httptest.NewRecorder()
+	serveWs(rm, w, r)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("status %d, want 503", w.Code)
+	}
+}
@@ -3,47 +3,311 @@
 package main
 
 import (
-	"log"
+	"context"
+	"log/slog"
+	"strconv"
+	"sync/atomic"
 	"time"
+
+	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// archivedRefreshInterval is how often running hubs re-read whether their
+// room is archived, and so how long the room command's archive takes to
+// reach connected clients.
+const archivedRefreshInterval = 10 * time.Second
+
 // Message defines the structure of messages exchanged between clients.
 type Message struct {
-	Type      string `json:"type"`           // Type of message: "message", "join", "leave"
+	Type      string `json:"type"`           // Type of message: "message", "join", "leave", "archived", "error", "throttled", "slowmode", "notice"
 	Content   string `json:"content"`        // Content of the message
 	User      string `json:"user,omitempty"` // Username of the sender (optional)
-	Timestamp string `json:"timestamp"`      // Timestamp of the message
+	Timestamp string `json:"timestamp"`      // When the message was sent, in timestampFormat; empty for notices
 	RowId     string `json:"rowid"`          // Row ID of the message
+
+	// Trace context of the frame or request that sent the message, which
+	// the hub continues. Nil for messages without one.
+	ctx context.Context
+}
+
+// Envelope addresses a message to a single client of the hub.
+type Envelope struct {
+	client  *Client
+	message Message
+}
+
+// KickRequest disconnects the clients match selects, with the given reason.
+type KickRequest struct {
+	match  func(*Client) bool
+	reason string
+}
+
+// CloseRequest carries the close code and reason sent to clients when a hub stops.
+type CloseRequest struct {
+	code   int
+	reason string
 }
 
 // Hub maintains the set of active Clients and handles message broadcasting.
 type Hub struct {
-	Clients    map[*Client]bool // Registered Clients
-	broadcast  chan Message     // Inbound messages from the Clients
-	register   chan *Client     // Register requests from the Clients
-	unregister chan *Client     // Unregister requests from Clients
-	history    []Message        // Chat history
-	roomID     string           // Room ID
-	db         *DB              // Pointer to database
+	Clients    map[*Client]bool            // Registered Clients
+	broadcast  chan Message                // Inbound messages from the Clients
+	notice     chan Message                // Room notices sent to every client without being stored
+	direct     chan Envelope               // Messages addressed to a single client
+	register   chan *Client                // Register requests from the Clients
+	unregister chan *Client                // Unregister requests from Clients
+	kicks      chan KickRequest            // Requests to disconnect some clients
+	quit       chan CloseRequest           // Shutdown requests carrying the close frame given to clients
+	done       chan struct{}               // Closed once run has returned
+	archived   atomic.Bool                 // Whether the room is read-only
+	clients    atomic.Int64                // len(Clients), for readers outside run
+	slowMode   atomic.Pointer[RateLimiter] // Per-user limit set by slow mode, nil when off
+	limits     *Limits                     // User and room send limits
+	history    []Message                   // Chat history
+	roomID     string                      // Room ID
+	db         Store                       // Pointer to database
+	persister  *Persister                  // Writes broadcasts to db in batches
+	log        *slog.Logger                // Logs the room's events, tagged with room
+
+	// Idle teardown. After idleTimeout without clients the hub asks release
+	// whether it may exit; release must refuse while joining is non-zero.
+	idleTimeout time.Duration
+	release     func(*Hub) bool
+	joining     int // Clients between lookup and registration, guarded by RoomManager.mu
+
+	// How often archived is re-read from db, zero for never.
+	archivedRefresh time.Duration
+}
+
+// storing is a broadcast waiting for the persister before it is fanned out.
+type storing struct {
+	message  Message
+	result   <-chan persistResult
+	received time.Time  // When the hub received the broadcast
+	span     trace.Span // Traces the broadcast until it is fanned out
+}
+
+// newHub creates a hub for the given room. The caller is responsible for starting run.
+func newHub(roomID string, db Store, persister *Persister) *Hub {
+	return &Hub{
+		broadcast:  make(chan Message),
+		notice:     make(chan Message),
+		direct:     make(chan Envelope),
+		register:   make(chan *Client),
+		unregister: make(chan *Client),
+		kicks:      make(chan KickRequest),
+		quit:       make(chan CloseRequest),
+		done:       make(chan struct{}),
+		Clients:    make(map[*Client]bool),
+		roomID:     roomID,
+		db:         db,
+		persister:  persister,
+		log:        slog.Default().With("room", roomID),
+	}
+}
+
+// post queues a message for broadcast without blocking the caller past the hub's lifetime.
+func (h *Hub) post(message Message) {
+	select {
+	case h.broadcast <- message:
+	case <-h.done:
+	}
+}
+
+// announce sends a notice to every client in the room. Notices are not stored.
+func (h *Hub) announce(message Message) {
+	select {
+	case h.notice <- message:
+	case <-h.done:
+	}
+}
+
+// sendTo delivers a message to a single client if it is still registered.
+func (h *Hub) sendTo(client *Client, message Message) {
+	select {
+	case h.direct <- Envelope{client: client, message: message}:
+	case <-h.done:
+	}
+}
+
+// watchArchived re-reads whether the room is archived every archivedRefresh
+// until the hub stops. Admin commands archive rooms in the database without
+// going through the running hub, so this is how the hub finds out. Clients
+// are told when it has changed; on error the known state stands.
+func (h *Hub) watchArchived() {
+	ticker := time.NewTicker(h.archivedRefresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-h.done:
+			return
+		}
+
+		room, err := h.db.GetRoom(context.Background(), h.roomID)
+		if err != nil {
+			h.log.Error("Error checking whether room is archived", "err", err)
+			continue
+		}
+		if room == nil || h.archived.Swap(room.Archived) == room.Archived {
+			continue
+		}
+		if room.Archived {
+			h.announce(Message{Type: "archived", Content: "This room has been archived"})
+		} else {
+			h.announce(Message{Type: "unarchived", Content: "This room is open again"})
+		}
+	}
+}
+
+// setSlowMode allows each user one message per interval. Zero turns slow mode off.
+func (h *Hub) setSlowMode(interval time.Duration) {
+	if interval <= 0 {
+		h.slowMode.Store(nil)
+		return
+	}
+	h.slowMode.Store(NewRateLimiter(1/interval.Seconds(), 1))
+}
+
+// allowSend applies slow mode and the user and room rate limits to a
+// message from username. When throttled it returns how long to wait for the
+// limit that rejected it; tokens the other limits took are given back, so a
+// rejected message doesn't count against them.
+func (h *Hub) allowSend(username string) (bool, time.Duration) {
+	slowMode := h.slowMode.Load()
+	if ok, wait := slowMode.Allow(username); !ok {
+		return false, wait
+	}
+	if h.limits == nil {
+		return true, 0
+	}
+	if ok, wait := h.limits.user.Allow(username); !ok {
+		slowMode.Refund(username)
+		return false, wait
+	}
+	if ok, wait := h.limits.room.Allow(h.roomID); !ok {
+		h.limits.user.Refund(username)
+		slowMode.Refund(username)
+		return false, wait
+	}
+	return true, 0
+}
+
+// kick disconnects the clients match selects, telling them why. Their
+// users are announced as having left.
+func (h *Hub) kick(match func(*Client) bool, reason string) {
+	select {
+	case h.kicks <- KickRequest{match: match, reason: reason}:
+	case <-h.done:
+	}
+}
+
+// stop disconnects every client with the given close code and reason,
+// stores any messages still waiting to be broadcast and ends run.
+// It returns once the hub has exited.
+func (h *Hub) stop(code int, reason string) {
+	select {
+	case h.quit <- CloseRequest{code: code, reason: reason}:
+	case <-h.done:
+	}
+	<-h.done
+}
+
+// disconnect removes a client from the hub and closes its connection
+// with the given close code and reason.
+func (h *Hub) disconnect(client *Client, code int, reason string) {
+	delete(h.Clients, client)
+	h.countClients()
+	client.closeCode = code
+	client.closeText = reason
+	close(client.send)
+}
+
+// countClients publishes the number of connected clients.
+func (h *Hub) countClients() {
+	h.clients.Store(int64(len(h.Clients)))
+	roomClients.WithLabelValues(h.roomID).Set(float64(len(h.Clients)))
 }
 
 // run starts the main event loop for the Hub,
 // processing register, unregister,and broadcast events.
 func (h *Hub) run() {
+	defer close(h.done)
+	activeHubs.Inc()
+	defer activeHubs.Dec()
+	defer roomClients.DeleteLabelValues(h.roomID)
+	h.log.Debug("Hub started")
+	defer h.log.Debug("Hub stopped")
+	if h.archivedRefresh > 0 {
+		go h.watchArchived()
+	}
+
+	// idle fires once the hub has had no clients for idleTimeout.
+	var idleTimer *time.Timer
+	var idle <-chan time.Time
+	checkIdle := func() {
+		if len(h.Clients) > 0 || h.idleTimeout <= 0 || h.release == nil {
+			if idleTimer != nil {
+				idleTimer.Stop()
+				idleTimer, idle = nil, nil
+			}
+			return
+		}
+		if idleTimer == nil {
+			idleTimer = time.NewTimer(h.idleTimeout)
+			idle = idleTimer.C
+		}
+	}
+	checkIdle()
+
+	// Broadcasts are fanned out in order once the persister has stored them
+	// and assigned their row IDs. Enqueueing blocks while the persister is
+	// behind, which holds up the clients' read pumps in turn.
+	var pending []storing
+
 	for {
+		var stored <-chan persistResult
+		if len(pending) > 0 {
+			stored = pending[0].result
+		}
+
 		select {
+		case <-idle:
+			idleTimer, idle = nil, nil
+			if len(h.Clients) == 0 && h.release(h) {
+				return
+			}
+			// Someone is joining; wait for them or another idle period.
+			checkIdle()
+
 		case client := <-h.register:
 			h.Clients[client] = true
+			h.countClients()
+			checkIdle()
 
-			// Send chat history to the new client
-			messages, err := h.db.GetRoomMessages(h.roomID)
+			// Send recent chat history to the new client
+			messages, err := h.db.GetRoomMessages(client.ctx, h.roomID, historyLimit)
 			if err != nil {
-				log.Printf("Error fetching chat history: %v", err)
+				client.log.Error("Error fetching chat history", "err", err)
 				continue
 			}
 
 			for _, msg := range messages {
-				client.send <- msg
+				h.deliver(client, msg)
+			}
+			// History is in creation order, so the newest id may be anywhere in it.
+			for _, msg := range messages {
+				if id, _ := strconv.ParseInt(msg.RowId, 10, 64); id > client.historyID {
+					client.historyID = id
+				}
+			}
+
+			// Tell the client up front when the room is read-only.
+			if h.archived.Load() {
+				h.deliver(client, Message{Type: "archived", Content: "This room is archived"})
 			}
 
 			// Check if this is the first connection for this user
@@ -55,58 +319,166 @@ func (h *Hub) run() {
 					break
 				}
 			}
-			if isNewUser {
+			if isNewUser && !h.archived.Load() {
 				joinMessage := Message{
 					Type:      "join",
 					Content:   "has joined the chat",
 					User:      client.user.Username,
-					Timestamp: time.Now().Format("Monday 3:04PM"),
+					Timestamp: formatTimestamp(time.Now()),
+					ctx:       client.ctx,
 				}
-				go func() { h.broadcast <- joinMessage }()
+				go h.post(joinMessage)
 			}
 
 		case client := <-h.unregister:
-			// Unregister an existing client.
+			// Unregister an existing client. Evicted clients were already
+			// removed and announced, so there is nothing left to do for them.
 			if _, ok := h.Clients[client]; ok {
 				delete(h.Clients, client)
+				h.countClients()
 				close(client.send)
+				h.announceLeave(client)
 			}
+			checkIdle()
 
-			// Check if this was the last connection for this user
-			// Broadcast leave message to all clients asynchronously.
-			isLastConnection := true
-			for remainingClient := range h.Clients {
-				if remainingClient.user.Username == client.user.Username {
-					isLastConnection = false
-					break
+		case message := <-h.broadcast:
+			ctx := message.ctx
+			if ctx == nil {
+				ctx = context.Background()
+			}
+			ctx, span := tracer().Start(ctx, "hub broadcast", roomAttributes(h.roomID, message.User, ""),
+				trace.WithAttributes(attribute.String("supchat.message_type", message.Type)))
+			pending = append(pending, storing{message: message, result: h.store(ctx, message), received: time.Now(), span: span})
+
+		case result := <-stored:
+			message, received, span := pending[0].message, pending[0].received, pending[0].span
+			pending = pending[1:]
+			if result.err != nil {
+				h.log.Error("Error storing message", "user", message.User, "err", result.err)
+				span.RecordError(result.err)
+				span.SetStatus(codes.Error, "error storing message")
+			} else {
+				message.RowId = strconv.FormatInt(result.id, 10)
+			}
+			span.AddEvent("stored")
+			recipients := 0
+			for client := range h.Clients {
+				// Skip clients whose history already included the message.
+				if result.err != nil || client.historyID < result.id {
+					h.deliver(client, message)
+					recipients++
 				}
 			}
-			if isLastConnection {
-				leaveMessage := Message{
-					Type:      "leave",
-					Content:   "has left the chat",
-					User:      client.user.Username,
-					Timestamp: time.Now().Format("Monday, 2006-01-02 15:04:05"),
+			span.SetAttributes(attribute.Int("supchat.recipients", recipients))
+			span.End()
+			broadcastMessages.WithLabelValues(message.Type).Inc()
+			broadcastLatency.Observe(time.Since(received).Seconds())
+			checkIdle()
+
+		case message := <-h.notice:
+			h.fanout(message)
+			checkIdle()
+
+		case req := <-h.kicks:
+			for client := range h.Clients {
+				if req.match(client) {
+					h.disconnect(client, websocket.ClosePolicyViolation, req.reason)
+					h.announceLeave(client)
 				}
-				go func() { h.broadcast <- leaveMessage }()
 			}
+			checkIdle()
 
-		case message := <-h.broadcast:
-			// Store message in the database
-			err := h.db.StoreMessage(h.roomID, message.User, message.Content, message.Timestamp)
-			if err != nil {
-				log.Printf("Error storing message: %v", err)
+		case envelope := <-h.direct:
+			if _, ok := h.Clients[envelope.client]; ok {
+				h.deliver(envelope.client, envelope.message)
 			}
+			checkIdle()
+
+		case req := <-h.quit:
+			// Disconnect everyone and exit. Late sends from pumps are
+			// released by the closed done channel.
 			for client := range h.Clients {
-				select {
-				case client.send <- message:
-					// Successfully sent the message to the client.
-				default:
-					// Failed to send the message, assume client is unresponsive and clean up.
-					close(client.send)
-					delete(h.Clients, client)
-				}
+				h.disconnect(client, req.code, req.reason)
 			}
+			h.drain()
+			return
+		}
+	}
+}
+
+// store queues a message with the persister.
+func (h *Hub) store(ctx context.Context, message Message) <-chan persistResult {
+	return h.persister.enqueue(ctx, PendingMessage{
+		RoomID:    h.roomID,
+		Type:      message.Type,
+		Username:  message.User,
+		Content:   message.Content,
+		Timestamp: message.Timestamp,
+	})
+}
+
+// drain queues messages that are already waiting on broadcast so that
+// nothing accepted from a client is lost when the hub stops. The
+// persister writes them before it closes.
+func (h *Hub) drain() {
+	for {
+		select {
+		case message := <-h.broadcast:
+			h.store(context.Background(), message)
+		default:
+			return
 		}
 	}
 }
+
+// announceLeave broadcasts a leave message if the client was the user's
+// last connection to the room.
+func (h *Hub) announceLeave(client *Client) {
+	for remainingClient := range h.Clients {
+		if remainingClient.user.Username == client.user.Username {
+			return
+		}
+	}
+	if h.archived.Load() {
+		return
+	}
+
+	// Broadcast asynchronously; the hub is the broadcast receiver.
+	leaveMessage := Message{
+		Type:      "leave",
+		Content:   "has left the chat",
+		User:      client.user.Username,
+		Timestamp: formatTimestamp(time.Now()),
+	}
+	go h.post(leaveMessage)
+}
+
+// fanout delivers a message to every registered client.
+func (h *Hub) fanout(message Message) {
+	for client := range h.Clients {
+		h.deliver(client, message)
+	}
+}
+
+// deliver queues a message for a client without blocking the hub.
+//
+// Slow consumers are disconnected: a client whose send buffer is full is
+// removed with a "try again later" close frame, counted in
+// sendQueueDrops and announced as having left. The buffer holds
+// sendBufferSize messages, so a client only trips this after falling that
+// far behind the room.
+func (h *Hub) deliver(client *Client, message Message) {
+	// A client evicted partway through a run of messages gets no more.
+	if !h.Clients[client] {
+		return
+	}
+	select {
+	case client.send <- message:
+		// Successfully queued the message for the client.
+	default:
+		h.disconnect(client, websocket.CloseTryAgainLater, "too slow to keep up")
+		sendQueueDrops.Inc()
+		client.log.Warn("Evicted slow client")
+		h.announceLeave(client)
+	}
+}
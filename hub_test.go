@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// startTestHub runs a hub for room "lobby" backed by a MemStore with users alice and bob.
+func startTestHub(t *testing.T) (*Hub, *MemStore) {
+	t.Helper()
+	ctx := context.Background()
+	store := NewMemStore()
+	store.CreateUser(ctx, "alice", "hash")
+	store.CreateUser(ctx, "bob", "hash")
+	store.CreateRoom(ctx, "lobby", "alice")
+
+	persister := NewPersister(store)
+	t.Cleanup(persister.Close)
+	hub := newHub("lobby", store, persister)
+	go hub.run()
+	t.Cleanup(func() { hub.stop(websocket.CloseNormalClosure, "") })
+	return hub, store
+}
+
+// joinTestHub registers a client without a connection; tests read client.send directly.
+func joinTestHub(hub *Hub, username string, buffer int) *Client {
+	client := &Client{hub: hub, send: make(chan Message, buffer), user: &User{Username: username}, log: slog.Default(), ctx: context.Background()}
+	hub.register <- client
+	return client
+}
+
+// expectMessage waits for the next message to the client and checks its type and user.
+func expectMessage(t *testing.T, client *Client, kind, user string) Message {
+	t.Helper()
+	select {
+	case m, ok := <-client.send:
+		if !ok {
+			t.Fatalf("%s: send closed, want %s from %s", client.user.Username, kind, user)
+		}
+		if m.Type != kind || m.User != user {
+			t.Fatalf("%s: got %s from %s (%q), want %s from %s", client.user.Username, m.Type, m.User, m.Content, kind, user)
+		}
+		return m
+	case <-time.After(time.Second):
+		t.Fatalf("%s: timed out waiting for %s from %s", client.user.Username, kind, user)
+	}
+	return Message{}
+}
+
+func TestHubBroadcastAndHistory(t *testing.T) {
+	hub, store := startTestHub(t)
+
+	alice := joinTestHub(hub, "alice", 16)
+	expectMessage(t, alice, "join", "alice")
+
+	hub.broadcast <- Message{Type: "message", Content: "hi", User: "alice"}
+	if m := expectMessage(t, alice, "message", "alice"); m.RowId == "" {
+		t.Error("broadcast has no row ID")
+	}
+
+	// A new client gets the stored history, then everyone sees it join.
+	bob := joinTestHub(hub, "bob", 16)
+	expectMessage(t, bob, "join", "alice")
+	expectMessage(t, bob, "message", "alice")
+	expectMessage(t, alice, "join", "bob")
+	expectMessage(t, bob, "join", "bob")
+
+	messages, _ := store.GetRoomMessages(context.Background(), "lobby", 0)
+	if len(messages) != 3 {
+		t.Errorf("stored %d messages, want 3", len(messages))
+	}
+}
+
+func TestHubEvictsSlowConsumer(t *testing.T) {
+	hub, _ := startTestHub(t)
+	before := testutil.ToFloat64(sendQueueDrops)
+
+	alice := joinTestHub(hub, "alice", 16)
+	expectMessage(t, alice, "join", "alice")
+	bob := joinTestHub(hub, "bob", 2)
+	expectMessage(t, alice, "join", "bob")
+
+	// Bob's buffer holds the history and his join message, so this overflows it.
+	hub.broadcast <- Message{Type: "message", Content: "hi", User: "alice"}
+	expectMessage(t, alice, "message", "alice")
+	expectMessage(t, alice, "leave", "bob")
+
+	expectMessage(t, bob, "join", "alice")
+	expectMessage(t, bob, "join", "bob")
+	if _, ok := <-bob.send; ok {
+		t.Fatal("bob's send channel is still open")
+	}
+	if bob.closeCode != websocket.CloseTryAgainLater {
+		t.Errorf("close code = %d, want %d", bob.closeCode, websocket.CloseTryAgainLater)
+	}
+	if got := testutil.ToFloat64(sendQueueDrops) - before; got != 1 {
+		t.Errorf("evictions = %v, want 1", got)
+	}
+
+	// The read pump unregisters the evicted client later; that must not
+	// announce a second leave.
+	hub.unregister <- bob
+	hub.broadcast <- Message{Type: "message", Content: "still here", User: "alice"}
+	expectMessage(t, alice, "message", "alice")
+}
+
+func TestHubHistoryDoesNotBlockRoom(t *testing.T) {
+	ctx := context.Background()
+	hub, store := startTestHub(t)
+	for i := 0; i < 2*sendBufferSize; i++ {
+		store.StoreMessage(ctx, "lobby", "alice", strconv.Itoa(i), formatTimestamp(time.Now()))
+	}
+
+	// bob never reads; his history is capped to fit his buffer, and the
+	// room carries on around him.
+	bob := joinTestHub(hub, "bob", sendBufferSize)
+	alice := joinTestHub(hub, "alice", 2*sendBufferSize)
+	for {
+		select {
+		case m := <-alice.send:
+			if m.Type == "join" && m.User == "alice" {
+				if len(bob.send) < historyLimit+1 {
+					t.Errorf("bob has %d messages queued, want %d of history and his join", len(bob.send), historyLimit+1)
+				}
+				if m := <-bob.send; m.Content != strconv.Itoa(2*sendBufferSize-historyLimit) {
+					t.Errorf("bob's history starts at %q", m.Content)
+				}
+				return
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for alice to join")
+		}
+	}
+}
+
+func TestHubIdleRelease(t *testing.T) {
+	store := NewMemStore()
+	hub := newHub("lobby", store, nil)
+	hub.idleTimeout = 10 * time.Millisecond
+
+	asked := make(chan struct{}, 10)
+	var allow atomic.Bool
+	hub.release = func(*Hub) bool {
+		asked <- struct{}{}
+		return allow.Load()
+	}
+	go hub.run()
+
+	// Refusing keeps the hub running and it asks again later.
+	<-asked
+	select {
+	case <-hub.done:
+		t.Fatal("hub exited after release refused")
+	default:
+	}
+	allow.Store(true)
+
+	select {
+	case <-hub.done:
+	case <-time.After(time.Second):
+		t.Fatal("idle hub did not exit")
+	}
+}
+
+func TestHubStopDrainsBroadcasts(t *testing.T) {
+	hub, store := startTestHub(t)
+	alice := joinTestHub(hub, "alice", 16)
+	expectMessage(t, alice, "join", "alice")
+
+	hub.stop(websocket.CloseServiceRestart, "server restarting")
+	if alice.closeCode != websocket.CloseServiceRestart || alice.closeText != "server restarting" {
+		t.Errorf("close frame = %d %q", alice.closeCode, alice.closeText)
+	}
+
+	// Sends after the hub stopped return instead of blocking.
+	hub.post(Message{Type: "message", Content: "late", User: "alice"})
+
+	messages, _ := store.GetRoomMessages(context.Background(), "lobby", 0)
+	if len(messages) != 1 {
+		t.Errorf("stored %d messages, want just the join", len(messages))
+	}
+}
@@ -0,0 +1,358 @@
+// import.go
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// unusablePassword is the password hash of imported users. It is not a
+// bcrypt hash, so no password matches it until an admin sets one.
+const unusablePassword = "!"
+
+// importBatchSize is how many messages are stored per transaction.
+const importBatchSize = 500
+
+// ImportedMessage is a message read from another chat's export.
+type ImportedMessage struct {
+	PendingMessage
+	CreatedAt time.Time
+	Key       string // Identifies the message in its source, so re-imports skip it
+}
+
+// ImportReport counts what an import added.
+type ImportReport struct {
+	Users      int // Users created
+	Rooms      int // Rooms created
+	Messages   int // Messages stored
+	Duplicates int // Messages skipped because an earlier import stored them
+	Skipped    int // Source entries that aren't chat messages
+}
+
+// importMessages creates the users and rooms the messages need and stores
+// the messages oldest first.
+func importMessages(ctx context.Context, store Store, messages []ImportedMessage) (ImportReport, error) {
+	var report ImportReport
+
+	// Order by the source's creation time; ties keep the source's order.
+	sort.SliceStable(messages, func(i, j int) bool {
+		return messages[i].CreatedAt.Before(messages[j].CreatedAt)
+	})
+
+	users := make(map[string]bool)
+	rooms := make(map[string]bool)
+	for _, m := range messages {
+		if !users[m.Username] {
+			users[m.Username] = true
+			user, err := store.GetUser(ctx, m.Username)
+			if err != nil {
+				return report, err
+			}
+			if user == nil {
+				if err := store.CreateUser(ctx, m.Username, unusablePassword); err != nil {
+					return report, err
+				}
+				report.Users++
+			}
+		}
+		if !rooms[m.RoomID] {
+			rooms[m.RoomID] = true
+			room, err := store.GetRoom(ctx, m.RoomID)
+			if err != nil {
+				return report, err
+			}
+			if room == nil {
+				// Imported rooms have no owner; admins manage them.
+				if err := store.CreateRoom(ctx, m.RoomID, ""); err != nil {
+					return report, err
+				}
+				report.Rooms++
+			}
+		}
+	}
+
+	for start := 0; start < len(messages); start += importBatchSize {
+		batch := messages[start:min(start+importBatchSize, len(messages))]
+		n, err := store.ImportMessages(ctx, batch)
+		if err != nil {
+			return report, err
+		}
+		report.Messages += n
+		report.Duplicates += len(batch) - n
+	}
+	return report, nil
+}
+
+// readJSONL reads messages in the JSON Lines format written by export.
+// The room field may be overridden with room. Times come from created_at,
+// since older exports have local timestamps. Messages are keyed by their
+// source ID and contents; identical lines count as separate messages.
+func readJSONL(path, room string) ([]ImportedMessage, int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	var messages []ImportedMessage
+	skipped := 0
+	seen := make(map[string]int) // Occurrences of each key so far
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		var entry struct {
+			ID        int64     `json:"id"`
+			Room      string    `json:"room"`
+			Type      string    `json:"type"`
+			User      string    `json:"user"`
+			Content   string    `json:"content"`
+			CreatedAt time.Time `json:"created_at"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, 0, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		source := entry.Room
+		if room != "" {
+			entry.Room = room
+		}
+		if entry.Type == "" {
+			entry.Type = "message"
+		}
+		if entry.Room == "" || entry.User == "" || entry.CreatedAt.IsZero() {
+			return nil, 0, fmt.Errorf("%s:%d: room, user and created_at are required", path, line)
+		}
+		if entry.Type != "message" && entry.Type != "join" && entry.Type != "leave" {
+			skipped++
+			continue
+		}
+		sum := sha256.Sum256([]byte(strings.Join([]string{
+			source, strconv.FormatInt(entry.ID, 10), entry.Type, entry.User, entry.CreatedAt.UTC().Format(time.RFC3339Nano), entry.Content,
+		}, "\x00")))
+		key := hex.EncodeToString(sum[:])
+		seen[key]++
+		messages = append(messages, ImportedMessage{
+			PendingMessage: PendingMessage{
+				RoomID:    entry.Room,
+				Type:      entry.Type,
+				Username:  entry.User,
+				Content:   entry.Content,
+				Timestamp: formatTimestamp(entry.CreatedAt),
+			},
+			CreatedAt: entry.CreatedAt,
+			Key:       fmt.Sprintf("jsonl:%s:%d", key, seen[key]),
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, 0, fmt.Errorf("%s: %w", path, err)
+	}
+	return messages, skipped, nil
+}
+
+// slackMessage is an entry of a channel's daily file in a Slack export.
+type slackMessage struct {
+	Type     string `json:"type"`
+	Subtype  string `json:"subtype"`
+	User     string `json:"user"`
+	Username string `json:"username"` // Set on bot messages
+	Text     string `json:"text"`
+	TS       string `json:"ts"`
+}
+
+// slackMarkup matches Slack's <...> references to users, channels and links.
+var slackMarkup = regexp.MustCompile(`<([^<>]*)>`)
+
+// readSlack reads the public channels of an unzipped Slack export: each
+// channel in channels.json becomes a room and users.json maps user IDs to
+// usernames. Joins and leaves are kept; topic changes and other events are skipped.
+func readSlack(dir string) ([]ImportedMessage, int, error) {
+	var users []struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	}
+	var channels []struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	}
+	if err := readJSONFile(filepath.Join(dir, "users.json"), &users); err != nil {
+		return nil, 0, err
+	}
+	if err := readJSONFile(filepath.Join(dir, "channels.json"), &channels); err != nil {
+		return nil, 0, err
+	}
+
+	names := make(map[string]string, len(users))
+	for _, u := range users {
+		names[u.ID] = u.Name
+	}
+	channelNames := make(map[string]string, len(channels))
+	for _, c := range channels {
+		// Names become directory paths and room IDs, so they must be one plain path element.
+		if c.Name == "" || c.Name == "." || c.Name == ".." || strings.ContainsAny(c.Name, `/\`) {
+			return nil, 0, fmt.Errorf("channels.json: invalid channel name %q", c.Name)
+		}
+		channelNames[c.ID] = c.Name
+	}
+
+	// Resolve Slack markup into plain text.
+	plain := func(text string) string {
+		text = slackMarkup.ReplaceAllStringFunc(text, func(ref string) string {
+			ref = ref[1 : len(ref)-1]
+			target, label, _ := strings.Cut(ref, "|")
+			switch {
+			case strings.HasPrefix(target, "@"):
+				if name, ok := names[target[1:]]; ok {
+					return "@" + name
+				}
+			case strings.HasPrefix(target, "#"):
+				if label == "" {
+					label = channelNames[target[1:]]
+				}
+				return "#" + label
+			case strings.HasPrefix(target, "!"):
+				return "@" + strings.TrimPrefix(target, "!")
+			case label != "":
+				return label + " (" + target + ")"
+			}
+			return target
+		})
+		// Slack escapes &, < and > in message text.
+		return html.UnescapeString(text)
+	}
+
+	var messages []ImportedMessage
+	skipped := 0
+	for _, channel := range channels {
+		days, err := filepath.Glob(filepath.Join(dir, channel.Name, "*.json"))
+		if err != nil {
+			return nil, 0, err
+		}
+		sort.Strings(days)
+		for _, day := range days {
+			var entries []slackMessage
+			if err := readJSONFile(day, &entries); err != nil {
+				return nil, 0, err
+			}
+			for _, entry := range entries {
+				createdAt, err := slackTime(entry.TS)
+				if entry.Type != "message" || err != nil {
+					skipped++
+					continue
+				}
+
+				m := ImportedMessage{
+					PendingMessage: PendingMessage{RoomID: channel.Name, Type: "message", Content: plain(entry.Text)},
+					CreatedAt:      createdAt,
+					Key:            "slack:" + channel.ID + ":" + entry.TS,
+				}
+				switch entry.Subtype {
+				case "", "thread_broadcast", "me_message", "file_share":
+				case "channel_join":
+					m.Type, m.Content = "join", "has joined the chat"
+				case "channel_leave":
+					m.Type, m.Content = "leave", "has left the chat"
+				case "bot_message":
+					entry.User = entry.Username
+				default:
+					skipped++
+					continue
+				}
+				if name, ok := names[entry.User]; ok {
+					m.Username = name
+				} else {
+					m.Username = entry.User
+				}
+				if m.Username == "" {
+					skipped++
+					continue
+				}
+				m.Timestamp = formatTimestamp(createdAt)
+				messages = append(messages, m)
+			}
+		}
+	}
+	return messages, skipped, nil
+}
+
+// slackTime parses a Slack message timestamp such as "1355517523.000005".
+func slackTime(ts string) (time.Time, error) {
+	secs, micros, _ := strings.Cut(ts, ".")
+	s, err := strconv.ParseInt(secs, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid Slack timestamp %q", ts)
+	}
+	us, _ := strconv.ParseInt(micros, 10, 64)
+	return time.Unix(s, us*1000).UTC(), nil
+}
+
+// readJSONFile decodes the JSON file at path into v.
+func readJSONFile(path string, v any) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// runImport implements the import command. A directory is read as a Slack
+// export and a file as JSON Lines. Running it again skips what was
+// already imported.
+func runImport(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	room := flags.String("room", "", "import a JSON Lines file into this room instead of the rooms it names")
+	c, err := parseCommand(flags, "SLACK_EXPORT_DIR|FILE.jsonl", args, 1)
+	if err != nil {
+		return err
+	}
+	path := flags.Arg(0)
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	var messages []ImportedMessage
+	var skipped int
+	if info.IsDir() {
+		if *room != "" {
+			return fmt.Errorf("-room only applies to JSON Lines files")
+		}
+		messages, skipped, err = readSlack(path)
+	} else {
+		messages, skipped, err = readJSONL(path, *room)
+	}
+	if err != nil {
+		return err
+	}
+
+	store, err := dialCurrentStore(c.DB)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	report, err := importMessages(context.Background(), store, messages)
+	report.Skipped = skipped
+	slog.Info("Imported messages", "messages", report.Messages, "duplicates", report.Duplicates,
+		"skipped", report.Skipped, "users", report.Users, "rooms", report.Rooms)
+	return err
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// writeSlackExport writes a small Slack export with one channel over two days.
+func writeSlackExport(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	files := map[string]string{
+		"users.json":    `[{"id": "U1", "name": "alice"}, {"id": "U2", "name": "bob"}]`,
+		"channels.json": `[{"id": "C1", "name": "general"}]`,
+		"general/2020-01-02.json": `[
+			{"type": "message", "user": "U2", "text": "later &amp; <@U1>", "ts": "1577923200.000100"}
+		]`,
+		"general/2020-01-01.json": `[
+			{"type": "message", "subtype": "channel_join", "user": "U1", "text": "<@U1> has joined the channel", "ts": "1577836800.000100"},
+			{"type": "message", "user": "U1", "text": "see <https://example.com|the site>", "ts": "1577836801.000200"},
+			{"type": "message", "subtype": "channel_topic", "user": "U1", "text": "set the topic", "ts": "1577836802.000300"}
+		]`,
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(path), 0o755)
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestImportSlackIsIdempotent(t *testing.T) {
+	ctx := context.Background()
+	for name, open := range storeFactories(t) {
+		t.Run(name, func(t *testing.T) {
+			store := open(t)
+			messages, skipped, err := readSlack(writeSlackExport(t))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if skipped != 1 {
+				t.Errorf("skipped %d entries, want the topic change", skipped)
+			}
+
+			report, err := importMessages(ctx, store, messages)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report != (ImportReport{Users: 2, Rooms: 1, Messages: 3}) {
+				t.Errorf("first import = %+v", report)
+			}
+			report, err = importMessages(ctx, store, messages)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report != (ImportReport{Messages: 0, Duplicates: 3}) {
+				t.Errorf("second import = %+v", report)
+			}
+
+			history, _ := store.GetRoomMessages(ctx, "general", 0)
+			if len(history) != 3 || history[0].Type != "join" ||
+				history[1].Content != "see the site (https://example.com)" ||
+				history[2].Content != "later & @alice" || history[2].User != "bob" {
+				t.Fatalf("history = %+v", history)
+			}
+
+			var first StoredMessage
+			store.ExportMessages(ctx, "general", time.Time{}, time.Time{}, func(m StoredMessage) error {
+				if first.ID == 0 {
+					first = m
+				}
+				return nil
+			})
+			if !first.CreatedAt.Truncate(time.Second).Equal(time.Unix(1577836800, 0)) {
+				t.Errorf("created at %v, want the Slack timestamp", first.CreatedAt)
+			}
+
+			user, _ := store.GetUser(ctx, "alice")
+			if user == nil || verifyPassword(user.HashedPassword, "") || verifyPassword(user.HashedPassword, "!") {
+				t.Errorf("imported user %+v can log in", user)
+			}
+			if room, _ := store.GetRoom(ctx, "general"); room == nil || room.Owner != "" {
+				t.Errorf("imported room = %+v", room)
+			}
+		})
+	}
+}
+
+func TestImportJSONLRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	source := NewMemStore()
+	source.CreateUser(ctx, "alice", "hash")
+	source.CreateRoom(ctx, "lobby", "alice")
+	source.StoreMessage(ctx, "lobby", "alice", "one", "2024-03-04T15:04:00.000Z")
+	source.StoreMessage(ctx, "lobby", "alice", "two", "2024-03-04T15:05:00.000Z")
+
+	var export bytes.Buffer
+	if err := exportRoom(ctx, source, &export, "jsonl", "lobby", time.Time{}, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "lobby.jsonl")
+	os.WriteFile(path, export.Bytes(), 0o644)
+
+	messages, _, err := readJSONL(path, "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := NewMemStore()
+	for i := 0; i < 2; i++ {
+		if _, err := importMessages(ctx, target, messages); err != nil {
+			t.Fatal(err)
+		}
+	}
+	history, _ := target.GetRoomMessages(ctx, "archive", 0)
+	if len(history) != 2 || history[0].Content != "one" || history[1].Timestamp != "2024-03-04T15:05:00.000Z" {
+		t.Errorf("history = %+v", history)
+	}
+}
+
+func TestImportIntoRoomWithHistory(t *testing.T) {
+	ctx := context.Background()
+	for name, open := range storeFactories(t) {
+		t.Run(name, func(t *testing.T) {
+			store := open(t)
+			store.CreateUser(ctx, "alice", "hash")
+			store.CreateRoom(ctx, "general", "alice")
+			store.StoreMessage(ctx, "general", "alice", "live", formatTimestamp(time.Now()))
+
+			messages, _, err := readSlack(writeSlackExport(t))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := importMessages(ctx, store, messages); err != nil {
+				t.Fatal(err)
+			}
+
+			// The imported messages are older, so they come first despite their newer ids.
+			history, _ := store.GetRoomMessages(ctx, "general", 0)
+			if len(history) != 4 || history[0].Type != "join" || history[3].Content != "live" {
+				t.Fatalf("history = %+v", history)
+			}
+			var exported []string
+			store.ExportMessages(ctx, "general", time.Time{}, time.Time{}, func(m StoredMessage) error {
+				exported = append(exported, m.Content)
+				return nil
+			})
+			if len(exported) != 4 || exported[3] != "live" {
+				t.Errorf("exported %q", exported)
+			}
+
+			// Retention keeps the newest by creation time, not the highest ids.
+			if n, err := store.PruneMessages(ctx, "general", time.Time{}, 1, 100); err != nil || n != 3 {
+				t.Errorf("pruned %d, %v; want the 3 imported", n, err)
+			}
+			if history, _ := store.GetRoomMessages(ctx, "general", 0); len(history) != 1 || history[0].Content != "live" {
+				t.Errorf("history after pruning = %+v", history)
+			}
+		})
+	}
+}
+
+func TestImportSlackRejectsChannelPaths(t *testing.T) {
+	for _, name := range []string{"..", "../etc", `a\b`, ""} {
+		dir := t.TempDir()
+		os.WriteFile(filepath.Join(dir, "users.json"), []byte(`[]`), 0o644)
+		os.WriteFile(filepath.Join(dir, "channels.json"), []byte(`[{"id": "C1", "name": `+strconv.Quote(name)+`}]`), 0o644)
+		if _, _, err := readSlack(dir); err == nil {
+			t.Errorf("read channel %q", name)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// captureLogs makes the default logger write JSON to the returned buffer
+// for the rest of the test.
+func captureLogs(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	logger, err := newLogger(&buf, "debug", "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := slog.Default()
+	slog.SetDefault(logger)
+	t.Cleanup(func() { slog.SetDefault(previous) })
+	return &buf
+}
+
+// logRecords decodes the JSON log lines in buf.
+func logRecords(t *testing.T, buf *bytes.Buffer) []map[string]any {
+	t.Helper()
+	var records []map[string]any
+	dec := json.NewDecoder(buf)
+	for dec.More() {
+		var record map[string]any
+		if err := dec.Decode(&record); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestLoggerTagsRequests(t *testing.T) {
+	logs := captureLogs(t)
+	handler := Logger(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		loggerFrom(r.Context()).Warn("Handling", "room", "lobby")
+	}))
+
+	for _, tc := range []struct {
+		sent string
+		kept bool
+	}{
+		{"", false},
+		{"proxy-1234.abc", true},
+		{"bad id\nwith a newline", false},
+	} {
+		logs.Reset()
+		r := httptest.NewRequest("GET", "/c/lobby", nil)
+		if tc.sent != "" {
+			r.Header.Set(requestIDHeader, tc.sent)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		id := w.Header().Get(requestIDHeader)
+		if id == "" || (id == tc.sent) != tc.kept {
+			t.Errorf("sent %q, got request ID %q", tc.sent, id)
+		}
+		records := logRecords(t, logs)
+		if len(records) != 2 {
+			t.Fatalf("logged %d records, want the handler's and the request's", len(records))
+		}
+		for _, record := range records {
+			if record["request_id"] != id {
+				t.Errorf("%s record has request_id %v, want %s", record["msg"], record["request_id"], id)
+			}
+		}
+		if records[0]["room"] != "lobby" || records[1]["status"] != float64(http.StatusOK) {
+			t.Errorf("records are missing fields: %v", records)
+		}
+	}
+}
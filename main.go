@@ -3,12 +3,28 @@
 package main
 
 import (
- 	"flag"
-	"html/template"
-	"log"
+	"bufio"
+ 	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 	"sync"
+	"sync/atomic"
+
+	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // Logger is a middleware that logs HTTP requests
@@ -16,13 +32,45 @@ func Logger(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
 
+		// Trace the request, continuing the client's trace if it sent one
+		route := routeOf(next, r)
+		name := route
+		if route == "other" {
+			name = r.Method
+		}
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer().Start(ctx, name, trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", r.Method),
+				attribute.String("http.route", route),
+				attribute.String("url.path", r.URL.Path),
+			))
+		defer span.End()
+
+		// Tag the request's logs with its ID
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = newID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		logger := slog.Default().With("request_id", id)
+		if sc := span.SpanContext(); sc.IsValid() {
+			logger = logger.With("trace_id", sc.TraceID().String())
+		}
+		r = r.WithContext(withLogger(ctx, logger))
+
 		// Create a ResponseRecorder to capture the status code
 		rr := &ResponseRecorder{ResponseWriter: w, statusCode: http.StatusOK}
 		next.ServeHTTP(rr, r)
 
 		duration := time.Since(start)
-		log.Printf("Method: %s, Route: %s, Status: %d, Duration: %v\n",
-			r.Method, r.URL.Path, rr.statusCode, duration)
+		logger.Info("Request",
+			"method", r.Method, "path", r.URL.Path, "status", rr.statusCode, "duration", duration)
+		observeRequest(r, route, rr.statusCode, duration)
+		span.SetAttributes(attribute.Int("http.response.status_code", rr.statusCode))
+		if rr.statusCode >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(rr.statusCode))
+		}
 	})
 }
 
@@ -38,46 +86,96 @@ func (rr *ResponseRecorder) WriteHeader(code int) {
 	rr.ResponseWriter.WriteHeader(code)
 }
 
+// Hijack lets WebSocket upgrades take over the connection
+func (rr *ResponseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(rr.ResponseWriter).Hijack()
+	if err == nil {
+		rr.statusCode = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
+
+// Unwrap gives http.ResponseController access to the wrapped writer
+func (rr *ResponseRecorder) Unwrap() http.ResponseWriter {
+	return rr.ResponseWriter
+}
+
 // User struct
 type User struct {
 	Username string
 	HashedPassword string
 	SessionToken string
+	IsAdmin bool
+	Disabled bool // Disabled users can't log in or use their sessions
+}
+
+// Session is a login, identified by the token in the user's cookie.
+type Session struct {
+	Token     string
+	Username  string
+	CreatedAt time.Time // Zero for sessions from before creation times were recorded
+}
+
+// Room struct
+type Room struct {
+	ID       string
+	Owner    string // Username of the user who created the room
+	Archived bool   // Archived rooms are read-only and hidden from the home page
+	SlowMode int    // Minimum seconds between messages from one user, 0 when off
+
+	// Retention overrides, 0 to use the server-wide setting.
+	RetainDays     int  // Delete messages older than this many days
+	RetainMessages int  // Keep at most this many messages
+	LegalHold      bool // Suspends pruning while set
 }
 
 // RoomManager manages multiple chat rooms and user sessions.
 type RoomManager struct {
 	Rooms     map[string]*Hub   // Maps room IDs to corresponding hubs.
 	Usernames map[string]*User 	// Maps usernames to users.
-	Sessions  map[string]*User 	// Maps session tokens to usernames.
+	admins    map[string]bool   // Usernames configured as admins.
+	hubIdleTimeout time.Duration // How long an empty hub lingers before shutting down.
+	archivedRefresh time.Duration // How often hubs re-read whether their room is archived.
+	limits    *Limits           // Send limits shared by every hub.
 	mu        sync.Mutex        // Mutex for safe concurrent access to maps.
-	db        *DB 				// Pointer to database
+	conns     sync.WaitGroup    // Tracks write pumps so shutdown can wait for close frames.
+	db        Store 			// Persistent storage
+	persister *Persister        // Writes messages to db in batches
+	backups   *Backups          // Online backups of db, nil if it can't take them
+	pages       *Pages          // Page templates and static assets
+	connLimits  ConnLimits      // WebSocket parameters of new clients
+	bcryptCost  int             // Cost of new password hashes
+	draining    atomic.Bool     // Set on shutdown to fail readiness and refuse new clients
+	schemaCurrent atomic.Bool   // Set once readiness has found no pending migrations
 }
 
 //
 // Serves 404 page
 //
-func serve404(w http.ResponseWriter, r *http.Request) {
-	http.ServeFile(w, r, "templates/404.html")
+func serve404(rm *RoomManager, w http.ResponseWriter, r *http.Request) {
+	if err := rm.pages.render(w, http.StatusNotFound, "404.html", nil); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
 }
 
 
 //
 // Serves home page
 //
-func serveHome(rm *RoomManager, w http.ResponseWriter) {
+func serveHome(rm *RoomManager, w http.ResponseWriter, r *http.Request) {
     type TemplateData struct {
         Rooms     map[string]int
         UserCount int
+        IsAdmin   bool
     }
 
-    rooms, err := rm.db.GetRooms()
+    rooms, err := rm.db.GetRooms(r.Context())
     if err != nil {
         http.Error(w, err.Error(), http.StatusInternalServerError)
         return
     }
 
-    userCount, err := rm.db.GetUserCount()
+    userCount, err := rm.db.GetUserCount(r.Context())
     if err != nil {
         http.Error(w, err.Error(), http.StatusInternalServerError)
         return
@@ -87,13 +185,11 @@ func serveHome(rm *RoomManager, w http.ResponseWriter) {
         Rooms:     rooms,
         UserCount: userCount,
     }
-
-    tmpl, err := template.ParseFiles("templates/home.html")
-    if err != nil {
-        http.Error(w, err.Error(), http.StatusInternalServerError)
-        return
+    if user := getUserFromSession(rm, r); user != nil {
+        data.IsAdmin = user.IsAdmin
     }
-    err = tmpl.Execute(w, data)
+
+    err = rm.pages.render(w, http.StatusOK, "home.html", data)
     if err != nil {
         http.Error(w, err.Error(), http.StatusInternalServerError)
         return
@@ -117,7 +213,7 @@ func serveStart(rm *RoomManager, w http.ResponseWriter, r *http.Request) {
 	rm.mu.Lock()
 	defer rm.mu.Unlock()
 
-	user, err := rm.db.GetUser(username)
+	user, err := rm.db.GetUser(r.Context(), username)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -125,35 +221,51 @@ func serveStart(rm *RoomManager, w http.ResponseWriter, r *http.Request) {
 
 	if user == nil {
 		// User doesn't exist, create new user
-		hashedPassword, err := hashPassword(password)
+		hashedPassword, err := hashPassword(password, rm.bcryptCost)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		err = rm.db.CreateUser(username, hashedPassword)
+		err = rm.db.CreateUser(r.Context(), username, hashedPassword)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 		user = &User{Username: username, HashedPassword: hashedPassword}
+		if rm.admins[username] {
+			if err := rm.db.SetAdmin(r.Context(), username, true); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			user.IsAdmin = true
+		}
 	} else {
 		// User exists, verify password
 		if !verifyPassword(user.HashedPassword, password) {
+			logins.WithLabelValues("failure").Inc()
+			loggerFrom(r.Context()).Info("Login failed", "user", username)
 			http.Error(w, "Incorrect password", http.StatusUnauthorized)
 			return
 		}
+		if user.Disabled {
+			logins.WithLabelValues("failure").Inc()
+			loggerFrom(r.Context()).Info("Login refused, user is disabled", "user", username)
+			http.Error(w, "This account has been disabled", http.StatusForbidden)
+			return
+		}
 	}
 
 	// Create session
 	sessionToken := generateSessionToken()
-	err = rm.db.CreateSession(sessionToken, username)
+	err = rm.db.CreateSession(r.Context(), sessionToken, username)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	user.SessionToken = sessionToken
-	rm.Sessions[sessionToken] = user
+	logins.WithLabelValues("success").Inc()
+	loggerFrom(r.Context()).Info("Logged in", "user", user.Username)
 
 	// Set session cookie
 	http.SetCookie(w, &http.Cookie{
@@ -161,6 +273,8 @@ func serveStart(rm *RoomManager, w http.ResponseWriter, r *http.Request) {
 		Value:    sessionToken,
 		Path:     "/",
 		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode, // Not sent on requests started by other sites
 	})
 
 	http.Redirect(w, r, r.Header.Get("Referer"), http.StatusFound)
@@ -174,19 +288,48 @@ func serveChat(rm *RoomManager, w http.ResponseWriter, r *http.Request) {
 	user := getUserFromSession(rm, r)
 	if user == nil {
 		roomID := r.PathValue("chatRoom")
-		tmpl, err := template.ParseFiles("templates/start.html")
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		err = tmpl.Execute(w, roomID)
+		err := rm.pages.render(w, http.StatusOK, "start.html", roomID)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 		return
 	}
-	http.ServeFile(w, r, "templates/room.html")
+
+	roomID := r.PathValue("chatRoom")
+	room, err := rm.db.GetRoom(r.Context(), roomID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	data := struct {
+		Room           string
+		CSRF           string
+		Archived       bool
+		SlowMode       int
+		RetainDays     int
+		RetainMessages int
+		LegalHold      bool
+		CanManage      bool
+		IsAdmin        bool
+	}{
+		Room:      roomID,
+		CSRF:      csrfToken(user.SessionToken),
+		Archived:  room != nil && room.Archived,
+		CanManage: room != nil && canManageRoom(user, room),
+		IsAdmin:   user.IsAdmin,
+	}
+	if room != nil {
+		data.SlowMode = room.SlowMode
+		data.RetainDays = room.RetainDays
+		data.RetainMessages = room.RetainMessages
+		data.LegalHold = room.LegalHold
+	}
+	err = rm.pages.render(w, http.StatusOK, "room.html", data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 }
 
 //
@@ -201,6 +344,12 @@ func serveWs(rm *RoomManager, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Send new clients to another server while shutting down
+	if rm.draining.Load() {
+		http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
 	// Check room id
 	roomID := r.PathValue("chatRoom")
 	if roomID == "" {
@@ -210,67 +359,187 @@ func serveWs(rm *RoomManager, w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Get or create hub
-	rm.mu.Lock()
-	hub, exists := rm.Rooms[roomID]
-	if !exists {
-		err := rm.db.CreateRoom(roomID)
-		if err != nil {
-			log.Printf("Error creating room: %v", err)
-			rm.mu.Unlock()
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
-			return
-		}
-		hub = &Hub{
-			broadcast:  make(chan Message),
-			register:   make(chan *Client),
-			unregister: make(chan *Client),
-			Clients:    make(map[*Client]bool),
-			roomID:     roomID,
-			db:         rm.db,
-		}
-		rm.Rooms[roomID] = hub
-		go hub.run()
+	logger := loggerFrom(r.Context()).With("room", roomID, "user", user.Username)
+	hub, err := rm.getHub(r.Context(), roomID, user)
+	if err != nil {
+		logger.Error("Error creating room", "err", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
 	}
-	rm.mu.Unlock()
+
+	defer rm.joined(hub)
 
 	// Upgrade the HTTP connection to a WebSocket connection.
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Println(err)
+		logger.Warn("WebSocket upgrade failed", "err", err)
 		return
 	}
 
 	// Create a new client and register it with the hub.
+	connID := newID()
+	trace.SpanFromContext(r.Context()).SetAttributes(attribute.String("supchat.conn_id", connID))
 	client := &Client{
 		hub: hub,
 		conn: conn,
-		send: make(chan Message, 256),
+		send: make(chan Message, sendBufferSize),
 		user: user,
+		id: connID,
+		log: logger.With("conn_id", connID),
+		ctx: context.WithoutCancel(r.Context()),
+		connLimits: rm.connLimits,
+	}
+	select {
+	case client.hub.register <- client:
+	case <-client.hub.done:
+		// The room was deleted while we were connecting.
+		conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "This room has been deleted"))
+		conn.Close()
+		return
 	}
-	client.hub.register <- client
+
+	client.log.Info("Client connected")
 
 	// Start the read and write pumps for the client.
 	// Allows collection of memory referenced by the caller by doing all work in new goroutines.
-	go client.writePump()
+	rm.conns.Add(1)
+	go func() {
+		defer rm.conns.Done()
+		client.writePump()
+	}()
 	go client.readPump()
 }
 
 func main() {
-	// Init database and create tables
-	db, err := InitDB("chat.db", false)
+	// Commands other than serving
+	args := os.Args[1:]
+	flag.Usage = usage
+	if len(args) > 0 {
+		switch args[0] {
+		case "serve":
+			args = args[1:]
+		case "export":
+			if err := runExport(os.Args[2:]); err != nil {
+				fatal("Export failed", err)
+			}
+			return
+		case "import":
+			if err := runImport(os.Args[2:]); err != nil {
+				fatal("Import failed", err)
+			}
+			return
+		case "config":
+			if err := runConfig(os.Args[2:]); err != nil {
+				fatal("Invalid configuration", err)
+			}
+			return
+		case "backup":
+			if err := runBackup(os.Args[2:]); err != nil {
+				fatal("Backup failed", err)
+			}
+			return
+		case "restore":
+			if err := runRestore(os.Args[2:]); err != nil {
+				fatal("Restore failed", err)
+			}
+			return
+		case "user":
+			if err := runUser(os.Args[2:], os.Stdin, os.Stdout); err != nil {
+				fatal("User command failed", err)
+			}
+			return
+		case "room":
+			if err := runRoom(os.Args[2:], os.Stdout); err != nil {
+				fatal("Room command failed", err)
+			}
+			return
+		case "sessions":
+			if err := runSessions(os.Args[2:], os.Stdout); err != nil {
+				fatal("Sessions command failed", err)
+			}
+			return
+		case "migrate":
+			if err := runMigrate(os.Args[2:], os.Stdout); err != nil {
+				fatal("Migration failed", err)
+			}
+			return
+		default:
+			if !strings.HasPrefix(args[0], "-") {
+				fmt.Fprintf(os.Stderr, "Unknown command %q\n", args[0])
+				usage()
+				os.Exit(2)
+			}
+		}
+	}
+
+    migrateDryRun := flag.Bool("migrate-dry-run", false, "list pending schema migrations and exit without applying them")
+    config, err := loadConfig(flag.CommandLine, args)
+    if err != nil {
+        fatal("Invalid configuration", err)
+    }
+    logger, err := setupLogging(config)
+    if err != nil {
+        fatal("Invalid configuration", err)
+    }
+    shutdownTracing, err := setupTracing(config)
+    if err != nil {
+        fatal("Tracing setup failed", err)
+    }
+
+	// Report pending migrations without applying them, as migrate -dry-run does.
+	if *migrateDryRun {
+		if err := runMigrate([]string{"-dry-run", "-db", config.DB}, os.Stdout); err != nil {
+			fatal("Checking migrations failed", err)
+		}
+		return
+	}
+
+	// Parse templates up front so broken ones stop startup
+	pages, err := NewPages(config.Dev, config.TemplateDir, config.AssetDir)
 	if err != nil {
-		log.Fatal("Database initialization failed: ", err)
+		fatal("Loading pages failed", err)
 	}
-	defer db.Close()
-	err = db.CreateTables()
+
+	// Open storage and bring the schema up to date
+	store, err := openStore(config.DB)
 	if err != nil {
-		log.Fatal("Table creation failed: ", err)
+		fatal("Database initialization failed", err)
 	}
 	var roomManager = &RoomManager{
 		Rooms:     make(map[string]*Hub),
 		Usernames: make(map[string]*User),
-		Sessions:  make(map[string]*User),
-		db:        db,
+		admins:    make(map[string]bool),
+		hubIdleTimeout: config.HubIdleTimeout,
+		archivedRefresh: archivedRefreshInterval,
+		limits: &Limits{
+			user: NewRateLimiter(config.UserRate, config.UserBurst),
+			room: NewRateLimiter(config.RoomRate, config.RoomBurst),
+		},
+		db:        store,
+		persister: NewPersister(store),
+		pages:       pages,
+		connLimits:  config.connLimits(),
+		bcryptCost:  config.BcryptCost,
+	}
+	// Prune messages past their retention in the background
+	var pruner *Pruner
+	if config.PruneInterval > 0 {
+		pruner = NewPruner(store, Retention{Days: config.RetainDays, Messages: config.RetainMessages})
+		pruner.start(config.PruneInterval)
+	}
+	// Back up on demand and, if configured, on a schedule
+	if db, ok := store.(Backuper); ok && config.DB != memoryDSN && !isPostgresDSN(config.DB) {
+		roomManager.backups = NewBackups(db, config.DB, config.BackupDir, config.BackupKeep)
+		if config.BackupInterval > 0 {
+			roomManager.backups.start(config.BackupInterval)
+		}
+	}
+
+	for _, name := range config.Admins {
+		roomManager.admins[name] = true
+		if err := store.SetAdmin(context.Background(), name, true); err != nil {
+			fatal("Granting admin rights failed", err)
+		}
 	}
 
 
@@ -278,30 +547,162 @@ func main() {
 	mux := http.NewServeMux()
 
 	// Static assets
-	mux.Handle("GET /assets/", http.StripPrefix("/assets/", http.FileServer(http.Dir("assets"))))
+	mux.HandleFunc("GET /assets/{name...}", pages.serveAsset)
+
+	// Probes
+	mux.HandleFunc("GET /healthz", serveHealthz)
+	mux.HandleFunc("GET /readyz", func(w http.ResponseWriter, r *http.Request) {
+		serveReadyz(roomManager, w, r)
+	})
 
 	// Routes
 	mux.HandleFunc("GET /", func(w http.ResponseWriter, r *http.Request) {
-		serve404(w, r)
+		serve404(roomManager, w, r)
 	})
 	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
-		serveHome(roomManager, w)
+		serveHome(roomManager, w, r)
 	})
 	mux.HandleFunc("POST /start", func(w http.ResponseWriter, r *http.Request) {
 		serveStart(roomManager, w, r)
 	})
+	mux.HandleFunc("GET /search", func(w http.ResponseWriter, r *http.Request) {
+		serveSearch(roomManager, w, r)
+	})
 	mux.HandleFunc("GET /c/{chatRoom}", func(w http.ResponseWriter, r *http.Request) {
 		serveChat(roomManager, w, r)
 	})
+	mux.HandleFunc("POST /c/{chatRoom}/archive", func(w http.ResponseWriter, r *http.Request) {
+		serveArchive(roomManager, w, r, true)
+	})
+	mux.HandleFunc("POST /c/{chatRoom}/unarchive", func(w http.ResponseWriter, r *http.Request) {
+		serveArchive(roomManager, w, r, false)
+	})
+	mux.HandleFunc("POST /c/{chatRoom}/slowmode", func(w http.ResponseWriter, r *http.Request) {
+		serveSlowMode(roomManager, w, r)
+	})
+	mux.HandleFunc("GET /c/{chatRoom}/export", func(w http.ResponseWriter, r *http.Request) {
+		serveExport(roomManager, w, r)
+	})
+	mux.HandleFunc("POST /c/{chatRoom}/retention", func(w http.ResponseWriter, r *http.Request) {
+		serveRetention(roomManager, w, r)
+	})
+	mux.HandleFunc("POST /c/{chatRoom}/hold", func(w http.ResponseWriter, r *http.Request) {
+		serveLegalHold(roomManager, w, r, true)
+	})
+	mux.HandleFunc("POST /c/{chatRoom}/release", func(w http.ResponseWriter, r *http.Request) {
+		serveLegalHold(roomManager, w, r, false)
+	})
+	mux.HandleFunc("POST /c/{chatRoom}/delete", func(w http.ResponseWriter, r *http.Request) {
+		serveDeleteRoom(roomManager, w, r)
+	})
+	mux.HandleFunc("GET /admin", func(w http.ResponseWriter, r *http.Request) {
+		serveAdmin(roomManager, w, r)
+	})
+	mux.HandleFunc("POST /admin/users/{username}/disable", func(w http.ResponseWriter, r *http.Request) {
+		serveAdminUser(roomManager, w, r, true)
+	})
+	mux.HandleFunc("POST /admin/users/{username}/enable", func(w http.ResponseWriter, r *http.Request) {
+		serveAdminUser(roomManager, w, r, false)
+	})
+	mux.HandleFunc("POST /admin/sessions/{session}/revoke", func(w http.ResponseWriter, r *http.Request) {
+		serveAdminRevoke(roomManager, w, r)
+	})
+	mux.HandleFunc("POST /admin/rooms/{chatRoom}/archive", func(w http.ResponseWriter, r *http.Request) {
+		serveAdminArchive(roomManager, w, r, true)
+	})
+	mux.HandleFunc("POST /admin/rooms/{chatRoom}/unarchive", func(w http.ResponseWriter, r *http.Request) {
+		serveAdminArchive(roomManager, w, r, false)
+	})
+	mux.HandleFunc("POST /admin/notice", func(w http.ResponseWriter, r *http.Request) {
+		serveAdminNotice(roomManager, w, r)
+	})
+	mux.HandleFunc("POST /admin/backup", func(w http.ResponseWriter, r *http.Request) {
+		serveBackup(roomManager, w, r)
+	})
 	mux.HandleFunc("GET /ws/{chatRoom}", func(w http.ResponseWriter, r *http.Request) {
 		serveWs(roomManager, w, r)
 	})
 
 	// Start server
-    port := flag.String("port", "8000", "specify the port to listen on")
-    flag.Parse()
-    err = http.ListenAndServe(":" + *port, mux)
+	server := &http.Server{
+		Addr:     ":" + config.Port,
+		Handler:  Logger(mux),
+		ErrorLog: slog.NewLogLogger(logger.Handler(), slog.LevelWarn),
+	}
+	redirectServer, err := configureTLS(config, server)
 	if err != nil {
-		log.Fatal("ListenAndServe: ", err)
+		fatal("TLS setup failed", err)
+	}
+	serverErr := make(chan error, 3)
+	go func() {
+		if server.TLSConfig != nil {
+			serverErr <- server.ListenAndServeTLS("", "")
+		} else {
+			serverErr <- server.ListenAndServe()
+		}
+	}()
+	if redirectServer != nil {
+		go func() {
+			serverErr <- redirectServer.ListenAndServe()
+		}()
+	}
+	var metricsServer *http.Server
+	if config.MetricsAddr != "" {
+		metricsServer = newMetricsServer(config.MetricsAddr)
+		go func() {
+			serverErr <- metricsServer.ListenAndServe()
+		}()
+	}
+
+	// Wait for a signal, then stop accepting connections, disconnect
+	// clients, flush pending messages and close the database.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	select {
+	case err := <-serverErr:
+		fatal("Serving HTTP failed", err)
+	case <-ctx.Done():
+	}
+	stop()
+	slog.Info("Shutting down")
+
+	// Fail readiness first, giving load balancers time to notice and stop
+	// sending new connections before the listener closes.
+	roomManager.draining.Store(true)
+	if config.DrainDelay > 0 {
+		slog.Info("Draining", "delay", config.DrainDelay)
+		time.Sleep(config.DrainDelay)
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("Error shutting down HTTP server", "err", err)
+	}
+	if redirectServer != nil {
+		redirectServer.Shutdown(shutdownCtx)
+	}
+	if metricsServer != nil {
+		metricsServer.Shutdown(shutdownCtx)
+	}
+	roomManager.shutdown(shutdownCtx)
+	roomManager.persister.Close()
+	if pruner != nil {
+		pruner.Close()
+	}
+	if roomManager.backups != nil {
+		roomManager.backups.Close()
+	}
+
+	if db, ok := store.(*DB); ok {
+		if err := db.Checkpoint(); err != nil {
+			slog.Error("Error checkpointing database", "err", err)
+		}
+	}
+	if err := store.Close(); err != nil {
+		slog.Error("Error closing database", "err", err)
+	}
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		slog.Error("Error exporting traces", "err", err)
 	}
 }
@@ -0,0 +1,479 @@
+// memstore.go
+
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Errors returned by MemStore where SQLite would report a constraint failure.
+var (
+	errUserExists  = errors.New("user already exists")
+	errNoSuchUser  = errors.New("no such user")
+	errNoSuchRoom  = errors.New("no such room")
+	errTokenExists = errors.New("session token already exists")
+)
+
+// memMessage is a stored message together with the fields Message doesn't carry.
+type memMessage struct {
+	id        int64
+	roomID    string
+	message   Message
+	createdAt time.Time
+}
+
+// MemStore is a Store that keeps everything in memory. It is meant for
+// tests and for ephemeral deployments; nothing survives a restart.
+type MemStore struct {
+	mu       sync.Mutex
+	users    map[string]User    // Keyed by username
+	sessions map[string]Session // Keyed by token
+	rooms    map[string]Room    // Keyed by room ID
+	messages []memMessage       // In creation order
+	imported map[string]bool    // Import keys already stored
+	nextID   int64
+}
+
+// NewMemStore returns an empty in-memory store.
+func NewMemStore() *MemStore {
+	return &MemStore{
+		users:    make(map[string]User),
+		sessions: make(map[string]Session),
+		rooms:    make(map[string]Room),
+		imported: make(map[string]bool),
+	}
+}
+
+func (s *MemStore) GetUser(ctx context.Context, username string) (*User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[username]
+	if !ok {
+		return nil, nil
+	}
+	return &user, nil
+}
+
+func (s *MemStore) CreateUser(ctx context.Context, username, hashedPassword string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[username]; ok {
+		return errUserExists
+	}
+	s.users[username] = User{Username: username, HashedPassword: hashedPassword}
+	return nil
+}
+
+func (s *MemStore) SetAdmin(ctx context.Context, username string, admin bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if user, ok := s.users[username]; ok {
+		user.IsAdmin = admin
+		s.users[username] = user
+	}
+	return nil
+}
+
+func (s *MemStore) SetUserDisabled(ctx context.Context, username string, disabled bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if user, ok := s.users[username]; ok {
+		user.Disabled = disabled
+		s.users[username] = user
+	}
+	return nil
+}
+
+func (s *MemStore) SetPassword(ctx context.Context, username, hashedPassword string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if user, ok := s.users[username]; ok {
+		user.HashedPassword = hashedPassword
+		s.users[username] = user
+	}
+	return nil
+}
+
+// ListUsers returns every user, disabled ones included.
+func (s *MemStore) ListUsers(ctx context.Context) ([]User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	users := make([]User, 0, len(s.users))
+	for _, user := range s.users {
+		users = append(users, user)
+	}
+	slices.SortFunc(users, func(a, b User) int { return strings.Compare(a.Username, b.Username) })
+	return users, nil
+}
+
+func (s *MemStore) GetUserCount(ctx context.Context) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.users), nil
+}
+
+func (s *MemStore) CreateSession(ctx context.Context, token, username string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[username]; !ok {
+		return errNoSuchUser
+	}
+	if _, ok := s.sessions[token]; ok {
+		return errTokenExists
+	}
+	s.sessions[token] = Session{Token: token, Username: username, CreatedAt: time.Now()}
+	return nil
+}
+
+func (s *MemStore) GetUserFromSession(ctx context.Context, token string) (*User, error) {
+	s.mu.Lock()
+	session, ok := s.sessions[token]
+	s.mu.Unlock()
+	if !ok {
+		return nil, nil
+	}
+	return s.GetUser(ctx, session.Username)
+}
+
+// ListSessions returns every session, newest first.
+func (s *MemStore) ListSessions(ctx context.Context) ([]Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sessions := make([]Session, 0, len(s.sessions))
+	for _, session := range s.sessions {
+		sessions = append(sessions, session)
+	}
+	slices.SortFunc(sessions, func(a, b Session) int {
+		if c := b.CreatedAt.Compare(a.CreatedAt); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Username, b.Username)
+	})
+	return sessions, nil
+}
+
+func (s *MemStore) DeleteSession(ctx context.Context, token string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.sessions, token)
+	return nil
+}
+
+func (s *MemStore) DeleteUserSessions(ctx context.Context, username string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for token, session := range s.sessions {
+		if session.Username == username {
+			delete(s.sessions, token)
+		}
+	}
+	return nil
+}
+
+func (s *MemStore) CreateRoom(ctx context.Context, roomID, owner string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.rooms[roomID]; !ok {
+		s.rooms[roomID] = Room{ID: roomID, Owner: owner}
+	}
+	return nil
+}
+
+func (s *MemStore) GetRoom(ctx context.Context, roomID string) (*Room, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	room, ok := s.rooms[roomID]
+	if !ok {
+		return nil, nil
+	}
+	return &room, nil
+}
+
+func (s *MemStore) GetRooms(ctx context.Context) (map[string]int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	users := make(map[string]map[string]bool)
+	for _, m := range s.messages {
+		if users[m.roomID] == nil {
+			users[m.roomID] = make(map[string]bool)
+		}
+		users[m.roomID][m.message.User] = true
+	}
+
+	rooms := make(map[string]int)
+	for roomID, room := range s.rooms {
+		if !room.Archived {
+			rooms[roomID] = len(users[roomID])
+		}
+	}
+	return rooms, nil
+}
+
+func (s *MemStore) SetRoomArchived(ctx context.Context, roomID string, archived bool) error {
+	return s.updateRoom(roomID, func(room *Room) { room.Archived = archived })
+}
+
+func (s *MemStore) SetRoomSlowMode(ctx context.Context, roomID string, seconds int) error {
+	return s.updateRoom(roomID, func(room *Room) { room.SlowMode = seconds })
+}
+
+func (s *MemStore) SetRoomRetention(ctx context.Context, roomID string, days, messages int) error {
+	return s.updateRoom(roomID, func(room *Room) { room.RetainDays, room.RetainMessages = days, messages })
+}
+
+func (s *MemStore) SetRoomLegalHold(ctx context.Context, roomID string, hold bool) error {
+	return s.updateRoom(roomID, func(room *Room) { room.LegalHold = hold })
+}
+
+// ListRooms returns every room, archived ones included, ordered by ID.
+func (s *MemStore) ListRooms(ctx context.Context) ([]Room, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rooms := make([]Room, 0, len(s.rooms))
+	for _, room := range s.rooms {
+		rooms = append(rooms, room)
+	}
+	slices.SortFunc(rooms, func(a, b Room) int { return strings.Compare(a.ID, b.ID) })
+	return rooms, nil
+}
+
+// updateRoom applies update to a room if it exists.
+func (s *MemStore) updateRoom(roomID string, update func(*Room)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if room, ok := s.rooms[roomID]; ok {
+		update(&room)
+		s.rooms[roomID] = room
+	}
+	return nil
+}
+
+func (s *MemStore) DeleteRoom(ctx context.Context, roomID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if room, ok := s.rooms[roomID]; !ok || room.LegalHold {
+		return errLegalHold
+	}
+	s.messages = slices.DeleteFunc(s.messages, func(m memMessage) bool { return m.roomID == roomID })
+	delete(s.rooms, roomID)
+	return nil
+}
+
+func (s *MemStore) StoreMessage(ctx context.Context, roomID, username, content, timestamp string) error {
+	_, err := s.StoreMessages(ctx, []PendingMessage{{roomID, "message", username, content, timestamp}})
+	return err
+}
+
+// StoreMessages stores messages and returns their IDs. Either all of them
+// are stored or none is.
+func (s *MemStore) StoreMessages(ctx context.Context, messages []PendingMessage) ([]int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, m := range messages {
+		if _, ok := s.rooms[m.RoomID]; !ok {
+			return nil, errNoSuchRoom
+		}
+		if _, ok := s.users[m.Username]; !ok {
+			return nil, errNoSuchUser
+		}
+	}
+
+	ids := make([]int64, len(messages))
+	for i, m := range messages {
+		ids[i] = s.append(m, messageTime(m.Timestamp))
+	}
+	return ids, nil
+}
+
+// ImportMessages stores imported messages, skipping those already imported.
+func (s *MemStore) ImportMessages(ctx context.Context, messages []ImportedMessage) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, m := range messages {
+		if _, ok := s.rooms[m.RoomID]; !ok {
+			return 0, errNoSuchRoom
+		}
+		if _, ok := s.users[m.Username]; !ok {
+			return 0, errNoSuchUser
+		}
+	}
+
+	imported := 0
+	for _, m := range messages {
+		if s.imported[m.Key] {
+			continue
+		}
+		s.imported[m.Key] = true
+		s.append(m.PendingMessage, m.CreatedAt)
+		imported++
+	}
+	return imported, nil
+}
+
+// append adds a message and returns its ID, keeping s.messages ordered by
+// creation time so that imported messages fall into place. The caller holds s.mu.
+func (s *MemStore) append(m PendingMessage, createdAt time.Time) int64 {
+	s.nextID++
+	i := len(s.messages)
+	for i > 0 && s.messages[i-1].createdAt.After(createdAt) {
+		i--
+	}
+	s.messages = slices.Insert(s.messages, i, memMessage{
+		id:     s.nextID,
+		roomID: m.RoomID,
+		message: Message{
+			Type:      m.Type,
+			Content:   m.Content,
+			User:      m.Username,
+			Timestamp: m.Timestamp,
+			RowId:     strconv.FormatInt(s.nextID, 10),
+		},
+		createdAt: createdAt,
+	})
+	return s.nextID
+}
+
+func (s *MemStore) GetRoomMessages(ctx context.Context, roomID string, limit int) ([]Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var messages []Message
+	for _, m := range s.messages {
+		if m.roomID == roomID {
+			messages = append(messages, m.message)
+		}
+	}
+	if limit > 0 && len(messages) > limit {
+		messages = messages[len(messages)-limit:]
+	}
+	return messages, nil
+}
+
+// PruneMessages deletes up to limit of a room's oldest messages that were
+// created before the given time or fall outside the newest keep.
+func (s *MemStore) PruneMessages(ctx context.Context, roomID string, before time.Time, keep, limit int) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.rooms[roomID].LegalHold {
+		return 0, nil
+	}
+
+	// Messages are in creation order, so the room's newest keep are its last ones.
+	count := 0
+	for _, m := range s.messages {
+		if m.roomID == roomID {
+			count++
+		}
+	}
+
+	deleted, seen := 0, 0
+	s.messages = slices.DeleteFunc(s.messages, func(m memMessage) bool {
+		if m.roomID != roomID {
+			return false
+		}
+		seen++
+		expired := !before.IsZero() && m.createdAt.Before(before) || keep > 0 && seen <= count-keep
+		if expired && deleted < limit {
+			deleted++
+			return true
+		}
+		return false
+	})
+	return deleted, nil
+}
+
+// ExportMessages calls fn for each of a room's messages created in [from, to), oldest first.
+func (s *MemStore) ExportMessages(ctx context.Context, roomID string, from, to time.Time, fn func(StoredMessage) error) error {
+	s.mu.Lock()
+	var messages []StoredMessage
+	for _, m := range s.messages {
+		if m.roomID != roomID ||
+			!from.IsZero() && m.createdAt.Before(from) ||
+			!to.IsZero() && !m.createdAt.Before(to) {
+			continue
+		}
+		messages = append(messages, StoredMessage{
+			ID:        m.id,
+			RoomID:    m.roomID,
+			Type:      m.message.Type,
+			User:      m.message.User,
+			Content:   m.message.Content,
+			Timestamp: m.message.Timestamp,
+			CreatedAt: m.createdAt.UTC(),
+		})
+	}
+	s.mu.Unlock()
+
+	// Call fn without the lock so it may use the store.
+	for _, m := range messages {
+		if err := fn(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SearchMessages matches words case-insensitively as substrings, newest first.
+func (s *MemStore) SearchMessages(ctx context.Context, q SearchQuery) ([]SearchResult, error) {
+	terms := strings.Fields(strings.ToLower(q.Text))
+	if len(terms) == 0 && q.RoomID == "" && q.Username == "" && q.From.IsZero() && q.To.IsZero() {
+		return nil, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var results []SearchResult
+	for i := len(s.messages) - 1; i >= 0 && len(results) < q.Limit; i-- {
+		m := s.messages[i]
+		if m.message.Type != "message" ||
+			q.RoomID != "" && m.roomID != q.RoomID ||
+			q.Username != "" && m.message.User != q.Username ||
+			!q.From.IsZero() && m.createdAt.Before(q.From) ||
+			!q.To.IsZero() && !m.createdAt.Before(q.To) {
+			continue
+		}
+		content := strings.ToLower(m.message.Content)
+		matched := true
+		for _, term := range terms {
+			if !strings.Contains(content, term) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			results = append(results, SearchResult{Message: m.message, RoomID: m.roomID})
+		}
+	}
+	return results, nil
+}
+
+func (s *MemStore) Close() error {
+	return nil
+}
@@ -0,0 +1,122 @@
+// metrics.go
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Prometheus metrics, served at /metrics on the metrics address.
+var (
+	roomClients = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "supchat_room_clients",
+		Help: "WebSocket clients connected to each room with a running hub.",
+	}, []string{"room"})
+
+	activeHubs = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "supchat_active_hubs",
+		Help: "Rooms with a running hub.",
+	})
+
+	broadcastMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "supchat_messages_total",
+		Help: "Messages broadcast to rooms, by type (message, join or leave).",
+	}, []string{"type"})
+
+	broadcastLatency = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "supchat_broadcast_fanout_seconds",
+		Help:    "Time from a hub receiving a broadcast to queueing it for every client, including the wait for the message to be stored.",
+		Buckets: prometheus.ExponentialBuckets(0.0005, 2, 14), // 0.5ms to 4s
+	})
+
+	sendQueueDrops = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "supchat_send_queue_drops_total",
+		Help: "Clients disconnected because their send queue was full.",
+	})
+
+	persistBatches = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "supchat_persist_batches_total",
+		Help: "Transactions written by the persister.",
+	})
+
+	persistedMessages = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "supchat_persisted_messages_total",
+		Help: "Messages written by the persister.",
+	})
+
+	prunedMessages = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "supchat_pruned_messages_total",
+		Help: "Messages deleted by retention.",
+	})
+
+	retentionHeldRooms = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "supchat_retention_held_rooms",
+		Help: "Rooms the latest pruning pass skipped because of a legal hold.",
+	})
+
+	retentionLastSuccess = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "supchat_retention_last_success_timestamp_seconds",
+		Help: "Unix time at which the latest pruning pass without errors finished.",
+	})
+
+	queryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "supchat_db_query_duration_seconds",
+		Help:    "Duration of store calls, by method.",
+		Buckets: prometheus.ExponentialBuckets(0.0001, 2, 16), // 0.1ms to 3s
+	}, []string{"method"})
+
+	logins = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "supchat_logins_total",
+		Help: "Login attempts, by result (success or failure). Sign-ups count as successes.",
+	}, []string{"result"})
+
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "supchat_http_request_duration_seconds",
+		Help:    "Duration of HTTP requests, by method, route pattern and status code. WebSocket requests are timed up to the upgrade.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route", "code"})
+)
+
+// newMetricsServer returns a server for /metrics on addr. It is kept off
+// the chat listener because the metrics name rooms.
+func newMetricsServer(addr string) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", promhttp.Handler())
+	return &http.Server{Addr: addr, Handler: mux}
+}
+
+// observeQuery times a store call and traces it. Use it as
+//
+//	defer observeQuery(ctx, "GetUser")()
+func observeQuery(ctx context.Context, method string) func() {
+	start := time.Now()
+	span := traceQuery(ctx, method)
+	return func() {
+		queryDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+		span.End()
+	}
+}
+
+// routeOf returns the mux pattern a request matches, or "other". Requests
+// are labelled with it rather than their path, which would make a series
+// per room.
+func routeOf(next http.Handler, r *http.Request) string {
+	if mux, ok := next.(*http.ServeMux); ok {
+		if _, pattern := mux.Handler(r); pattern != "" {
+			return pattern
+		}
+	}
+	return "other"
+}
+
+// observeRequest records an HTTP request's duration.
+func observeRequest(r *http.Request, route string, status int, duration time.Duration) {
+	httpDuration.WithLabelValues(r.Method, route, strconv.Itoa(status)).Observe(duration.Seconds())
+}
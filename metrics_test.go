@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// samples returns how many observations a histogram has.
+func samples(t *testing.T, h prometheus.Observer) uint64 {
+	t.Helper()
+	var m dto.Metric
+	if err := h.(prometheus.Metric).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram().GetSampleCount()
+}
+
+func TestHubMetrics(t *testing.T) {
+	hub, _ := startTestHub(t)
+	messages := testutil.ToFloat64(broadcastMessages.WithLabelValues("message"))
+	fanouts := samples(t, broadcastLatency)
+
+	alice := joinTestHub(hub, "alice", 16)
+	expectMessage(t, alice, "join", "alice")
+	bob := joinTestHub(hub, "bob", 16)
+	expectMessage(t, bob, "join", "alice")
+	expectMessage(t, alice, "join", "bob")
+	expectMessage(t, bob, "join", "bob")
+	if n := testutil.ToFloat64(roomClients.WithLabelValues("lobby")); n != 2 {
+		t.Errorf("lobby has %v clients, want 2", n)
+	}
+
+	hub.broadcast <- Message{Type: "message", Content: "hi", User: "alice"}
+	expectMessage(t, alice, "message", "alice")
+	if n := testutil.ToFloat64(broadcastMessages.WithLabelValues("message")) - messages; n != 1 {
+		t.Errorf("counted %v messages, want 1", n)
+	}
+
+	hub.unregister <- bob
+	expectMessage(t, alice, "leave", "bob")
+	if n := testutil.ToFloat64(roomClients.WithLabelValues("lobby")); n != 1 {
+		t.Errorf("lobby has %v clients after bob left, want 1", n)
+	}
+	// The two joins and the message were timed before the hub handled the
+	// leave; the leave itself may still be in flight.
+	if n := samples(t, broadcastLatency) - fanouts; n < 3 {
+		t.Errorf("timed %d fan-outs, want at least 3", n)
+	}
+}
+
+func TestLoggerRecordsRoutes(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /c/{chatRoom}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	observed := httpDuration.WithLabelValues("GET", "GET /c/{chatRoom}", "418")
+	before := samples(t, observed)
+	Logger(mux).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/c/lobby", nil))
+	if n := samples(t, observed) - before; n != 1 {
+		t.Errorf("recorded %d requests, want 1", n)
+	}
+
+	want := `supchat_http_request_duration_seconds_count{code="418",method="GET",route="GET /c/{chatRoom}"}`
+	w := httptest.NewRecorder()
+	newMetricsServer("").Handler.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.Contains(w.Body.String(), want) {
+		t.Errorf("/metrics doesn't contain %s", want)
+	}
+}
@@ -0,0 +1,270 @@
+// migrations.go
+
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrSchemaTooNew is returned when the database was migrated by a newer binary.
+var ErrSchemaTooNew = errors.New("database schema is newer than this binary")
+
+// migration is one numbered step of the schema. Versions start at 1 and
+// must stay in order; never edit or renumber a migration once released,
+// add a new one instead.
+type migration struct {
+	version     int
+	description string
+	up          func(tx *sql.Tx) error
+}
+
+// migrations lists every SQLite schema change. The statements tolerate
+// databases created before schema_migrations existed, which already have some of it.
+// Changes must be mirrored in pgMigrations.
+var migrations = []migration{
+	{1, "create users, sessions, rooms and messages", func(tx *sql.Tx) error {
+		return execAll(tx,
+			`CREATE TABLE IF NOT EXISTS users (
+				username TEXT PRIMARY KEY,
+				hashed_password TEXT NOT NULL
+			)`,
+			`CREATE TABLE IF NOT EXISTS sessions (
+				token TEXT PRIMARY KEY,
+				username TEXT NOT NULL,
+				FOREIGN KEY (username) REFERENCES users(username)
+			)`,
+			`CREATE TABLE IF NOT EXISTS rooms (
+				id TEXT PRIMARY KEY
+			)`,
+			`CREATE TABLE IF NOT EXISTS messages (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				room_id TEXT NOT NULL,
+				username TEXT NOT NULL,
+				content TEXT NOT NULL,
+				timestamp TEXT NOT NULL,
+				FOREIGN KEY (room_id) REFERENCES rooms(id),
+				FOREIGN KEY (username) REFERENCES users(username)
+			)`,
+		)
+	}},
+	{2, "add admins, room owners and archiving", func(tx *sql.Tx) error {
+		if err := addColumn(tx, "users", "is_admin", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+			return err
+		}
+		if err := addColumn(tx, "rooms", "owner", "TEXT"); err != nil {
+			return err
+		}
+		return addColumn(tx, "rooms", "archived", "INTEGER NOT NULL DEFAULT 0")
+	}},
+	{3, "add room slow mode", func(tx *sql.Tx) error {
+		return addColumn(tx, "rooms", "slow_mode", "INTEGER NOT NULL DEFAULT 0")
+	}},
+	{4, "add message creation time", func(tx *sql.Tx) error {
+		return addColumn(tx, "messages", "created_at", "INTEGER")
+	}},
+	{5, "add retention policies and legal hold", func(tx *sql.Tx) error {
+		if err := addColumn(tx, "rooms", "retain_days", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+			return err
+		}
+		if err := addColumn(tx, "rooms", "retain_messages", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+			return err
+		}
+		if err := addColumn(tx, "rooms", "legal_hold", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+			return err
+		}
+		// Pruning and history walk a room's messages in id order.
+		return execAll(tx, `CREATE INDEX IF NOT EXISTS messages_room_id ON messages (room_id, id)`)
+	}},
+	{6, "record message types", func(tx *sql.Tx) error {
+		if err := addColumn(tx, "messages", "type", "TEXT NOT NULL DEFAULT 'message'"); err != nil {
+			return err
+		}
+		// Older joins and leaves were stored as plain messages.
+		return execAll(tx,
+			`UPDATE messages SET type = 'join' WHERE type = 'message' AND content = 'has joined the chat'`,
+			`UPDATE messages SET type = 'leave' WHERE type = 'message' AND content = 'has left the chat'`,
+		)
+	}},
+	{7, "track imported messages", func(tx *sql.Tx) error {
+		if err := addColumn(tx, "messages", "import_key", "TEXT"); err != nil {
+			return err
+		}
+		return execAll(tx, `CREATE UNIQUE INDEX IF NOT EXISTS messages_import_key ON messages (import_key)`)
+	}},
+	{8, "store message times in UTC", convertTimestamps},
+	{9, "add disabled users and session creation times", func(tx *sql.Tx) error {
+		if err := addColumn(tx, "users", "disabled", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+			return err
+		}
+		return addColumn(tx, "sessions", "created_at", "INTEGER")
+	}},
+	{10, "order history by creation time", func(tx *sql.Tx) error {
+		// Imported messages get new ids, so history is walked by created_at instead.
+		return execAll(tx,
+			datePreviousMessages,
+			`CREATE INDEX IF NOT EXISTS messages_room_created ON messages (room_id, created_at, id)`,
+		)
+	}},
+}
+
+// datePreviousMessages gives messages without a creation time that of the
+// message before them in their room, or failing that the one after, so that
+// ordering history by creation time keeps them where they were.
+const datePreviousMessages = `UPDATE messages SET created_at = COALESCE(
+		(SELECT p.created_at FROM messages p
+			WHERE p.room_id = messages.room_id AND p.id < messages.id AND p.created_at IS NOT NULL
+			ORDER BY p.id DESC LIMIT 1),
+		(SELECT n.created_at FROM messages n
+			WHERE n.room_id = messages.room_id AND n.id > messages.id AND n.created_at IS NOT NULL
+			ORDER BY n.id LIMIT 1))
+	WHERE created_at IS NULL`
+
+// migrationSet is the migration history of one database engine.
+type migrationSet struct {
+	migrations []migration
+
+	// versionTable counts the tables named schema_migrations, without creating anything.
+	versionTable string
+}
+
+// sqliteSchema is the schema of the SQLite backend.
+var sqliteSchema = migrationSet{
+	migrations:   migrations,
+	versionTable: "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'schema_migrations'",
+}
+
+// latest is the schema version this binary expects.
+func (set migrationSet) latest() int {
+	return set.migrations[len(set.migrations)-1].version
+}
+
+// version returns the highest migration applied to the database,
+// or 0 if migrations have never run.
+func (set migrationSet) version(db *sql.DB) (int, error) {
+	var exists int
+	err := db.QueryRow(set.versionTable).Scan(&exists)
+	if err != nil {
+		return 0, fmt.Errorf("error reading schema version: %w", err)
+	}
+	if exists == 0 {
+		return 0, nil
+	}
+
+	var version int
+	err = db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&version)
+	if err != nil {
+		return 0, fmt.Errorf("error reading schema version: %w", err)
+	}
+	return version, nil
+}
+
+// pending returns the migrations not yet applied to the database.
+// It fails with ErrSchemaTooNew if the database is ahead of this binary.
+func (set migrationSet) pending(db *sql.DB) ([]migration, error) {
+	version, err := set.version(db)
+	if err != nil {
+		return nil, err
+	}
+	if version > set.latest() {
+		return nil, fmt.Errorf("%w: database is at version %d, binary supports up to %d", ErrSchemaTooNew, version, set.latest())
+	}
+
+	var pending []migration
+	for _, m := range set.migrations {
+		if m.version > version {
+			pending = append(pending, m)
+		}
+	}
+	return pending, nil
+}
+
+// apply runs all pending migrations in a single transaction.
+func (set migrationSet) apply(db *sql.DB) error {
+	pending, err := set.pending(db)
+	if err != nil || len(pending) == 0 {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting migration: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		description TEXT NOT NULL,
+		applied_at TEXT NOT NULL
+	)`)
+	if err != nil {
+		return fmt.Errorf("error creating schema_migrations: %w", err)
+	}
+
+	for _, m := range pending {
+		if err := m.up(tx); err != nil {
+			return fmt.Errorf("error applying migration %d (%s): %w", m.version, m.description, err)
+		}
+		_, err = tx.Exec("INSERT INTO schema_migrations (version, description, applied_at) VALUES ($1, $2, $3)",
+			m.version, m.description, time.Now().UTC().Format(time.RFC3339))
+		if err != nil {
+			return fmt.Errorf("error recording migration %d: %w", m.version, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing migrations: %w", err)
+	}
+	return nil
+}
+
+// SchemaVersion returns the highest migration applied to the database,
+// or 0 if migrations have never run.
+func (db *DB) SchemaVersion() (int, error) {
+	return sqliteSchema.version(db.DB)
+}
+
+// PendingMigrations returns the migrations not yet applied to the database.
+// It fails with ErrSchemaTooNew if the database is ahead of this binary.
+func (db *DB) PendingMigrations() ([]migration, error) {
+	return sqliteSchema.pending(db.DB)
+}
+
+// Migrate applies all pending migrations in a single transaction and then
+// sets up the optional search index.
+func (db *DB) Migrate() error {
+	if err := sqliteSchema.apply(db.DB); err != nil {
+		return err
+	}
+	return db.createSearchIndex()
+}
+
+// execAll runs statements in order, stopping at the first error.
+func execAll(tx *sql.Tx, statements ...string) error {
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addColumn adds a column to a table unless it is already present.
+func addColumn(tx *sql.Tx, table, column, definition string) error {
+	var exists int
+	err := tx.QueryRow("SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?", table, column).Scan(&exists)
+	if err != nil {
+		return fmt.Errorf("error reading table info: %w", err)
+	}
+	if exists > 0 {
+		return nil
+	}
+
+	_, err = tx.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + definition)
+	if err != nil {
+		return fmt.Errorf("error adding column %s.%s: %w", table, column, err)
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMigrateDryRun(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "chat.db")
+
+	// A dry run lists every migration of a new database and applies none.
+	var out bytes.Buffer
+	if err := runMigrate([]string{"-dry-run", "-db", path}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(out.String()), "\n"); len(lines) != len(migrations) {
+		t.Errorf("dry run listed %d migrations, want %d:\n%s", len(lines), len(migrations), out.String())
+	}
+	if !strings.Contains(out.String(), fmt.Sprintf("Would apply migration 1: %s", migrations[0].description)) {
+		t.Errorf("dry run output:\n%s", out.String())
+	}
+	db, err := OpenDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	version, err := db.SchemaVersion()
+	db.Close()
+	if err != nil || version != 0 {
+		t.Fatalf("schema version after a dry run = %d, %v", version, err)
+	}
+
+	out.Reset()
+	if err := runMigrate([]string{"-db", path}, &out); err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	if err := runMigrate([]string{"-dry-run", "-db", path}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "Database schema is up to date\n" {
+		t.Errorf("dry run after migrating:\n%s", out.String())
+	}
+}
+
+func TestStartupRefusesNewerSchema(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "chat.db")
+	db := openTestDB(t, path)
+	_, err := db.Exec("INSERT INTO schema_migrations (version, description, applied_at) VALUES (?, 'from the future', '')", sqliteSchema.latest()+1)
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if store, err := openStore(path); !errors.Is(err, ErrSchemaTooNew) {
+		if store != nil {
+			store.Close()
+		}
+		t.Fatalf("openStore on a newer schema: %v, want ErrSchemaTooNew", err)
+	}
+	if err := runMigrate([]string{"-dry-run", "-db", path}, &bytes.Buffer{}); !errors.Is(err, ErrSchemaTooNew) {
+		t.Errorf("dry run on a newer schema: %v, want ErrSchemaTooNew", err)
+	}
+}
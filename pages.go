@@ -0,0 +1,174 @@
+// pages.go
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// embedded holds the page templates and static assets built into the binary.
+//
+//go:embed templates/*.html assets
+var embedded embed.FS
+
+// assetCacheControl is sent for fingerprinted asset URLs, whose content
+// never changes; plain asset URLs must be revalidated.
+const assetCacheControl = "public, max-age=31536000, immutable"
+
+// Pages renders the page templates and serves the static assets.
+// Templates link to assets with {{ asset "room.css" }}, which gives the
+// asset's fingerprinted URL, so browsers may cache it for good and fetch
+// it again as soon as it changes.
+type Pages struct {
+	site *site                 // Parsed once; nil in dev mode
+	load func() (*site, error) // Reads the templates and assets
+}
+
+// site is one reading of the templates and assets.
+type site struct {
+	templates map[string]*template.Template // By file name
+	assets    map[string]*asset             // By file name and by fingerprinted name
+}
+
+// asset is a static file and its fingerprint.
+type asset struct {
+	name   string // File name, like "room.css"
+	hashed string // Name with the content hash, like "room.3f9a1c2e.css"
+	data   []byte
+	etag   string
+}
+
+// NewPages returns pages built from the embedded files, parsed once. In dev
+// mode they are read from templateDir and assetDir instead, on every
+// request, so edits show up on reload without restarting the server.
+func NewPages(dev bool, templateDir, assetDir string) (*Pages, error) {
+	if dev {
+		return &Pages{load: func() (*site, error) {
+			return loadSite(os.DirFS(templateDir), os.DirFS(assetDir))
+		}}, nil
+	}
+
+	templates, _ := fs.Sub(embedded, "templates")
+	assets, _ := fs.Sub(embedded, "assets")
+	s, err := loadSite(templates, assets)
+	if err != nil {
+		return nil, err
+	}
+	return &Pages{site: s}, nil
+}
+
+// current returns the site to serve.
+func (p *Pages) current() (*site, error) {
+	if p.site != nil {
+		return p.site, nil
+	}
+	return p.load()
+}
+
+// loadSite reads and fingerprints the assets, then parses the templates.
+func loadSite(templates, assets fs.FS) (*site, error) {
+	s := &site{templates: make(map[string]*template.Template), assets: make(map[string]*asset)}
+
+	err := fs.WalkDir(assets, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := fs.ReadFile(assets, name)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(data)
+		hash := hex.EncodeToString(sum[:4])
+		ext := path.Ext(name)
+		a := &asset{
+			name:   name,
+			hashed: strings.TrimSuffix(name, ext) + "." + hash + ext,
+			data:   data,
+			etag:   `"` + hash + `"`,
+		}
+		s.assets[a.name] = a
+		s.assets[a.hashed] = a
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error reading assets: %w", err)
+	}
+
+	funcs := template.FuncMap{
+		"asset": func(name string) (string, error) {
+			a, ok := s.assets[name]
+			if !ok {
+				return "", fmt.Errorf("unknown asset %q", name)
+			}
+			return "/assets/" + a.hashed, nil
+		},
+	}
+	names, err := fs.Glob(templates, "*.html")
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		tmpl, err := template.New(name).Funcs(funcs).ParseFS(templates, name)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing template: %w", err)
+		}
+		s.templates[name] = tmpl
+	}
+	return s, nil
+}
+
+// render executes the named template and sends the page with the given
+// status. The page is rendered in full first, so a failing template
+// produces an error response rather than half a page.
+func (p *Pages) render(w http.ResponseWriter, status int, name string, data any) error {
+	s, err := p.current()
+	if err != nil {
+		return err
+	}
+	tmpl, ok := s.templates[name]
+	if !ok {
+		return fmt.Errorf("unknown template %q", name)
+	}
+	var page bytes.Buffer
+	if err := tmpl.Execute(&page, data); err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	_, err = page.WriteTo(w)
+	return err
+}
+
+// serveAsset serves a static asset under its plain or fingerprinted name.
+func (p *Pages) serveAsset(w http.ResponseWriter, r *http.Request) {
+	s, err := p.current()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	name := r.PathValue("name")
+	a, ok := s.assets[name]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	if name == a.hashed {
+		w.Header().Set("Cache-Control", assetCacheControl)
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	w.Header().Set("ETag", a.etag)
+	http.ServeContent(w, r, a.name, time.Time{}, bytes.NewReader(a.data))
+}
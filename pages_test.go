@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// assetLink finds a stylesheet link in a rendered page.
+var assetLink = regexp.MustCompile(`href="(/assets/[^"]+)"`)
+
+// get serves a request to an asset or, for other paths, the 404 page.
+func get(pages *Pages, path string, header http.Header) *httptest.ResponseRecorder {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /assets/{name...}", pages.serveAsset)
+	mux.HandleFunc("GET /", func(w http.ResponseWriter, r *http.Request) {
+		serve404(&RoomManager{pages: pages}, w, r)
+	})
+	r := httptest.NewRequest("GET", path, nil)
+	for key, values := range header {
+		r.Header[key] = values
+	}
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	return w
+}
+
+func TestEmbeddedAssetsAreFingerprinted(t *testing.T) {
+	pages, err := NewPages(false, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	page := get(pages, "/missing", nil)
+	if page.Code != http.StatusNotFound {
+		t.Errorf("404 page sent status %d", page.Code)
+	}
+	link := assetLink.FindStringSubmatch(page.Body.String())
+	if link == nil || !regexp.MustCompile(`^/assets/base\.[0-9a-f]{8}\.css$`).MatchString(link[1]) {
+		t.Fatalf("404 page links %v, want a fingerprinted base.css", link)
+	}
+
+	hashed := get(pages, link[1], nil)
+	if hashed.Code != http.StatusOK || hashed.Header().Get("Cache-Control") != assetCacheControl ||
+		!strings.HasPrefix(hashed.Header().Get("Content-Type"), "text/css") {
+		t.Errorf("fingerprinted asset: %d %v", hashed.Code, hashed.Header())
+	}
+	plain := get(pages, "/assets/base.css", nil)
+	if plain.Header().Get("Cache-Control") != "no-cache" || plain.Body.String() != hashed.Body.String() {
+		t.Errorf("plain asset: %v", plain.Header())
+	}
+	revalidated := get(pages, "/assets/base.css", http.Header{"If-None-Match": {plain.Header().Get("ETag")}})
+	if revalidated.Code != http.StatusNotModified {
+		t.Errorf("revalidating with the ETag sent status %d", revalidated.Code)
+	}
+	if get(pages, "/assets/base.00000000.css", nil).Code != http.StatusNotFound {
+		t.Error("served an asset under a stale fingerprint")
+	}
+}
+
+func TestDevPagesReload(t *testing.T) {
+	dir := t.TempDir()
+	templates, assets := filepath.Join(dir, "templates"), filepath.Join(dir, "assets")
+	os.Mkdir(templates, 0o755)
+	os.Mkdir(assets, 0o755)
+	os.WriteFile(filepath.Join(templates, "404.html"), []byte(`<link rel="stylesheet" href="{{ asset "base.css" }}">`), 0o644)
+	os.WriteFile(filepath.Join(assets, "base.css"), []byte("body { color: red; }"), 0o644)
+
+	pages, err := NewPages(true, templates, assets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := assetLink.FindStringSubmatch(get(pages, "/", nil).Body.String())
+	os.WriteFile(filepath.Join(assets, "base.css"), []byte("body { color: blue; }"), 0o644)
+	after := assetLink.FindStringSubmatch(get(pages, "/", nil).Body.String())
+	if before == nil || after == nil || before[1] == after[1] {
+		t.Fatalf("links before and after editing the asset: %v, %v", before, after)
+	}
+	if body := get(pages, after[1], nil).Body.String(); body != "body { color: blue; }" {
+		t.Errorf("served %q after editing the asset", body)
+	}
+}
@@ -0,0 +1,191 @@
+// persister.go
+
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// persistQueueSize is how many messages may wait to be written before
+	// hubs block on enqueue, which in turn stops their clients' read pumps.
+	persistQueueSize = 1024
+
+	// persistBatchSize caps the number of messages written in one transaction.
+	persistBatchSize = 256
+)
+
+// errPersisterClosed is returned for messages enqueued after Close.
+var errPersisterClosed = errors.New("persister is closed")
+
+// PendingMessage is a message waiting to be written by StoreMessages.
+type PendingMessage struct {
+	RoomID    string
+	Type      string // "message", "join" or "leave"
+	Username  string
+	Content   string
+	Timestamp string
+}
+
+// persistResult is the outcome of writing one message.
+type persistResult struct {
+	id  int64 // Row ID assigned by the store
+	err error
+}
+
+// persistRequest is a queued message and where to report its result.
+type persistRequest struct {
+	message PendingMessage
+	result  chan persistResult // Buffered so the persister never blocks on it
+	link    trace.Link         // To the span of the hub that queued it
+	flushed chan struct{}      // Set on flush requests, which carry no message
+}
+
+// Persister writes messages from every hub behind their backs. It takes
+// whatever is queued, up to persistBatchSize messages, and stores it in a
+// single transaction, so a busy server pays for one commit per batch
+// instead of one per message. Each message's result, including its row ID,
+// is reported in enqueue order.
+type Persister struct {
+	store  Store
+	queue  chan persistRequest
+	mu     sync.RWMutex // Guards closed against enqueues racing Close
+	closed bool
+	done   chan struct{} // Closed once everything queued has been written
+}
+
+// NewPersister starts a persister writing to store.
+func NewPersister(store Store) *Persister {
+	p := &Persister{
+		store: store,
+		queue: make(chan persistRequest, persistQueueSize),
+		done:  make(chan struct{}),
+	}
+	go p.run()
+	return p
+}
+
+// enqueue queues a message and returns the channel its result will be
+// sent on. It blocks while the queue is full. The batch that writes the
+// message is linked to the span in ctx.
+func (p *Persister) enqueue(ctx context.Context, message PendingMessage) <-chan persistResult {
+	result := make(chan persistResult, 1)
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		result <- persistResult{err: errPersisterClosed}
+		return result
+	}
+	p.queue <- persistRequest{message: message, result: result, link: trace.LinkFromContext(ctx)}
+	return result
+}
+
+// flush returns once every message queued before it has been written.
+func (p *Persister) flush() {
+	flushed := make(chan struct{})
+
+	p.mu.RLock()
+	if p.closed {
+		p.mu.RUnlock()
+		<-p.done
+		return
+	}
+	p.queue <- persistRequest{flushed: flushed}
+	p.mu.RUnlock()
+	<-flushed
+}
+
+// Close stops accepting messages and returns once everything already
+// queued has been written.
+func (p *Persister) Close() {
+	p.mu.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.queue)
+	}
+	p.mu.Unlock()
+	<-p.done
+}
+
+// run collects batches from the queue and writes them until Close.
+func (p *Persister) run() {
+	defer close(p.done)
+
+	batch := make([]persistRequest, 0, persistBatchSize)
+	for req := range p.queue {
+		if req.flushed != nil {
+			close(req.flushed)
+			continue
+		}
+		batch = append(batch[:0], req)
+		var flushed chan struct{}
+	collect:
+		for len(batch) < persistBatchSize {
+			select {
+			case req, ok := <-p.queue:
+				if !ok {
+					break collect
+				}
+				if req.flushed != nil {
+					// Write what came before the flush, then release it.
+					flushed = req.flushed
+					break collect
+				}
+				batch = append(batch, req)
+			default:
+				break collect
+			}
+		}
+		p.write(batch)
+		if flushed != nil {
+			close(flushed)
+		}
+	}
+}
+
+// write stores a batch in one transaction. If that fails, for example
+// because a room was deleted while its messages were queued, the messages
+// are retried one by one so a single bad message doesn't lose the rest.
+func (p *Persister) write(batch []persistRequest) {
+	messages := make([]PendingMessage, len(batch))
+	links := make([]trace.Link, 0, len(batch))
+	for i, req := range batch {
+		messages[i] = req.message
+		if req.link.SpanContext.IsValid() {
+			links = append(links, req.link)
+		}
+	}
+
+	// A batch serves many traces, so it starts its own and links to theirs.
+	ctx, span := tracer().Start(context.Background(), "persist batch", trace.WithNewRoot(), trace.WithLinks(links...),
+		trace.WithAttributes(attribute.Int("supchat.messages", len(batch))))
+	defer span.End()
+
+	ids, err := p.store.StoreMessages(ctx, messages)
+	if err == nil {
+		persistBatches.Inc()
+		persistedMessages.Add(float64(len(batch)))
+		for i, req := range batch {
+			req.result <- persistResult{id: ids[i]}
+		}
+		return
+	}
+	span.RecordError(err)
+	span.SetStatus(codes.Error, "error storing messages")
+	if len(batch) > 1 {
+		slog.Warn("Error storing batch of messages, retrying one by one", "messages", len(batch), "err", err)
+		for _, req := range batch {
+			p.write([]persistRequest{req})
+		}
+		return
+	}
+	batch[0].result <- persistResult{err: err}
+}
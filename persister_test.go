@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+func TestPersisterOrdersResultsAndFlushesOnClose(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemStore()
+	store.CreateUser(ctx, "alice", "hash")
+	store.CreateRoom(ctx, "lobby", "alice")
+	persister := NewPersister(store)
+
+	var results []<-chan persistResult
+	for i := 0; i < 500; i++ {
+		room := "lobby"
+		if i == 250 {
+			// Fails its batch, which must not take the others down with it.
+			room = "missing"
+		}
+		results = append(results, persister.enqueue(ctx, PendingMessage{room, "message", "alice", fmt.Sprint(i), "Monday 3:04PM"}))
+	}
+	persister.Close()
+
+	var last int64
+	for i, result := range results {
+		r := <-result
+		if i == 250 {
+			if r.err == nil {
+				t.Error("message to a missing room was stored")
+			}
+			continue
+		}
+		if r.err != nil || r.id <= last {
+			t.Fatalf("message %d: id %d after %d, err %v", i, r.id, last, r.err)
+		}
+		last = r.id
+	}
+
+	messages, _ := store.GetRoomMessages(ctx, "lobby", 0)
+	if len(messages) != 499 {
+		t.Errorf("stored %d messages, want 499", len(messages))
+	}
+	if r := <-persister.enqueue(ctx, PendingMessage{"lobby", "message", "alice", "late", ""}); r.err != errPersisterClosed {
+		t.Errorf("enqueue after Close: %v", r.err)
+	}
+}
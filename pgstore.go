@@ -0,0 +1,654 @@
+// pgstore.go
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "github.com/jackc/pgx/v5/stdlib"
+)
+
+// PGStore is a Store backed by PostgreSQL. Unlike DB it allows many
+// concurrent writers, so the pool isn't limited to one connection.
+type PGStore struct {
+	*sql.DB
+}
+
+// pgMigrations mirrors migrations for PostgreSQL, version for version.
+var pgMigrations = []migration{
+	{1, "create users, sessions, rooms and messages", func(tx *sql.Tx) error {
+		return execAll(tx,
+			`CREATE TABLE users (
+				username TEXT PRIMARY KEY,
+				hashed_password TEXT NOT NULL
+			)`,
+			`CREATE TABLE sessions (
+				token TEXT PRIMARY KEY,
+				username TEXT NOT NULL REFERENCES users(username)
+			)`,
+			`CREATE TABLE rooms (
+				id TEXT PRIMARY KEY
+			)`,
+			`CREATE TABLE messages (
+				id BIGSERIAL PRIMARY KEY,
+				room_id TEXT NOT NULL REFERENCES rooms(id),
+				username TEXT NOT NULL REFERENCES users(username),
+				content TEXT NOT NULL,
+				timestamp TEXT NOT NULL
+			)`,
+			`CREATE INDEX messages_room_id ON messages (room_id, id)`,
+		)
+	}},
+	{2, "add admins, room owners and archiving", func(tx *sql.Tx) error {
+		return execAll(tx,
+			`ALTER TABLE users ADD COLUMN is_admin BOOLEAN NOT NULL DEFAULT FALSE`,
+			`ALTER TABLE rooms ADD COLUMN owner TEXT`,
+			`ALTER TABLE rooms ADD COLUMN archived BOOLEAN NOT NULL DEFAULT FALSE`,
+		)
+	}},
+	{3, "add room slow mode", func(tx *sql.Tx) error {
+		return execAll(tx, `ALTER TABLE rooms ADD COLUMN slow_mode INTEGER NOT NULL DEFAULT 0`)
+	}},
+	{4, "add message creation time", func(tx *sql.Tx) error {
+		return execAll(tx,
+			`ALTER TABLE messages ADD COLUMN created_at BIGINT`,
+			`ALTER TABLE messages ADD COLUMN search tsvector
+				GENERATED ALWAYS AS (to_tsvector('simple', content)) STORED`,
+			`CREATE INDEX messages_search ON messages USING GIN (search)`,
+		)
+	}},
+	{5, "add retention policies and legal hold", func(tx *sql.Tx) error {
+		return execAll(tx,
+			`ALTER TABLE rooms ADD COLUMN retain_days INTEGER NOT NULL DEFAULT 0`,
+			`ALTER TABLE rooms ADD COLUMN retain_messages INTEGER NOT NULL DEFAULT 0`,
+			`ALTER TABLE rooms ADD COLUMN legal_hold BOOLEAN NOT NULL DEFAULT FALSE`,
+		)
+	}},
+	{6, "record message types", func(tx *sql.Tx) error {
+		return execAll(tx,
+			`ALTER TABLE messages ADD COLUMN type TEXT NOT NULL DEFAULT 'message'`,
+			`UPDATE messages SET type = 'join' WHERE content = 'has joined the chat'`,
+			`UPDATE messages SET type = 'leave' WHERE content = 'has left the chat'`,
+		)
+	}},
+	{7, "track imported messages", func(tx *sql.Tx) error {
+		return execAll(tx,
+			`ALTER TABLE messages ADD COLUMN import_key TEXT`,
+			`CREATE UNIQUE INDEX messages_import_key ON messages (import_key)`,
+		)
+	}},
+	{8, "store message times in UTC", convertTimestamps},
+	{9, "add disabled users and session creation times", func(tx *sql.Tx) error {
+		return execAll(tx,
+			`ALTER TABLE users ADD COLUMN disabled BOOLEAN NOT NULL DEFAULT FALSE`,
+			`ALTER TABLE sessions ADD COLUMN created_at BIGINT`,
+		)
+	}},
+	{10, "order history by creation time", func(tx *sql.Tx) error {
+		return execAll(tx,
+			datePreviousMessages,
+			`CREATE INDEX messages_room_created ON messages (room_id, created_at NULLS FIRST, id)`,
+		)
+	}},
+}
+
+// pgSchema is the schema of the PostgreSQL backend.
+var pgSchema = migrationSet{
+	migrations:   pgMigrations,
+	versionTable: "SELECT COUNT(*) FROM pg_tables WHERE schemaname = current_schema() AND tablename = 'schema_migrations'",
+}
+
+// isPostgresDSN reports whether a -db setting names a PostgreSQL database.
+func isPostgresDSN(dsn string) bool {
+	return strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://")
+}
+
+// OpenPGStore connects to the PostgreSQL database at dsn.
+func OpenPGStore(dsn string) (*PGStore, error) {
+	db, err := sql.Open("pgx", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("error opening database: %w", err)
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error connecting to database: %w", err)
+	}
+	return &PGStore{db}, nil
+}
+
+// PendingMigrations returns the migrations not yet applied to the database.
+func (db *PGStore) PendingMigrations() ([]migration, error) {
+	return pgSchema.pending(db.DB)
+}
+
+// Migrate applies all pending migrations in a single transaction.
+func (db *PGStore) Migrate() error {
+	return pgSchema.apply(db.DB)
+}
+
+func (db *PGStore) GetUser(ctx context.Context, username string) (*User, error) {
+	defer observeQuery(ctx, "GetUser")()
+	user, err := scanUser(db.QueryRowContext(ctx, "SELECT "+userColumns+" FROM users WHERE username = $1", username))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error querying user: %w", err)
+	}
+	return user, nil
+}
+
+// ListUsers returns every user, disabled ones included.
+func (db *PGStore) ListUsers(ctx context.Context) ([]User, error) {
+	defer observeQuery(ctx, "ListUsers")()
+	rows, err := db.QueryContext(ctx, "SELECT "+userColumns+" FROM users ORDER BY username")
+	if err != nil {
+		return nil, fmt.Errorf("error listing users: %w", err)
+	}
+	defer rows.Close()
+
+	var users []User
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning user row: %w", err)
+		}
+		users = append(users, *user)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating user rows: %w", err)
+	}
+	return users, nil
+}
+
+func (db *PGStore) CreateUser(ctx context.Context, username, hashedPassword string) error {
+	defer observeQuery(ctx, "CreateUser")()
+	_, err := db.ExecContext(ctx, "INSERT INTO users (username, hashed_password) VALUES ($1, $2)", username, hashedPassword)
+	if err != nil {
+		return fmt.Errorf("error creating user: %w", err)
+	}
+	return nil
+}
+
+func (db *PGStore) SetAdmin(ctx context.Context, username string, admin bool) error {
+	defer observeQuery(ctx, "SetAdmin")()
+	_, err := db.ExecContext(ctx, "UPDATE users SET is_admin = $1 WHERE username = $2", admin, username)
+	if err != nil {
+		return fmt.Errorf("error updating user: %w", err)
+	}
+	return nil
+}
+
+func (db *PGStore) GetUserCount(ctx context.Context) (int, error) {
+	defer observeQuery(ctx, "GetUserCount")()
+	var count int
+	err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM users").Scan(&count)
+	return count, err
+}
+
+// SetUserDisabled disables or re-enables a user. It doesn't touch their
+// sessions; DeleteUserSessions logs them out.
+func (db *PGStore) SetUserDisabled(ctx context.Context, username string, disabled bool) error {
+	defer observeQuery(ctx, "SetUserDisabled")()
+	_, err := db.ExecContext(ctx, "UPDATE users SET disabled = $1 WHERE username = $2", disabled, username)
+	if err != nil {
+		return fmt.Errorf("error updating user: %w", err)
+	}
+	return nil
+}
+
+func (db *PGStore) SetPassword(ctx context.Context, username, hashedPassword string) error {
+	defer observeQuery(ctx, "SetPassword")()
+	_, err := db.ExecContext(ctx, "UPDATE users SET hashed_password = $1 WHERE username = $2", hashedPassword, username)
+	if err != nil {
+		return fmt.Errorf("error updating password: %w", err)
+	}
+	return nil
+}
+
+func (db *PGStore) CreateSession(ctx context.Context, token, username string) error {
+	defer observeQuery(ctx, "CreateSession")()
+	_, err := db.ExecContext(ctx, "INSERT INTO sessions (token, username, created_at) VALUES ($1, $2, $3)", token, username, time.Now().Unix())
+	if err != nil {
+		return fmt.Errorf("error creating session: %w", err)
+	}
+	return nil
+}
+
+func (db *PGStore) GetUserFromSession(ctx context.Context, token string) (*User, error) {
+	defer observeQuery(ctx, "GetUserFromSession")()
+	var username string
+	err := db.QueryRowContext(ctx, "SELECT username FROM sessions WHERE token = $1", token).Scan(&username)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error querying session: %w", err)
+	}
+
+	return db.GetUser(ctx, username)
+}
+
+// ListSessions returns every session, newest first.
+func (db *PGStore) ListSessions(ctx context.Context) ([]Session, error) {
+	defer observeQuery(ctx, "ListSessions")()
+	rows, err := db.QueryContext(ctx, "SELECT token, username, created_at FROM sessions ORDER BY created_at DESC NULLS LAST, username")
+	if err != nil {
+		return nil, fmt.Errorf("error listing sessions: %w", err)
+	}
+	return scanSessions(rows)
+}
+
+// DeleteSession logs a session out.
+func (db *PGStore) DeleteSession(ctx context.Context, token string) error {
+	defer observeQuery(ctx, "DeleteSession")()
+	_, err := db.ExecContext(ctx, "DELETE FROM sessions WHERE token = $1", token)
+	if err != nil {
+		return fmt.Errorf("error deleting session: %w", err)
+	}
+	return nil
+}
+
+// DeleteUserSessions logs a user out everywhere.
+func (db *PGStore) DeleteUserSessions(ctx context.Context, username string) error {
+	defer observeQuery(ctx, "DeleteUserSessions")()
+	_, err := db.ExecContext(ctx, "DELETE FROM sessions WHERE username = $1", username)
+	if err != nil {
+		return fmt.Errorf("error deleting sessions: %w", err)
+	}
+	return nil
+}
+
+// CreateRoom creates a room owned by the given user. Existing rooms are left untouched.
+func (db *PGStore) CreateRoom(ctx context.Context, roomID, owner string) error {
+	defer observeQuery(ctx, "CreateRoom")()
+	_, err := db.ExecContext(ctx, "INSERT INTO rooms (id, owner) VALUES ($1, $2) ON CONFLICT (id) DO NOTHING", roomID, owner)
+	if err != nil {
+		return fmt.Errorf("error creating room: %w", err)
+	}
+	return nil
+}
+
+func (db *PGStore) GetRoom(ctx context.Context, roomID string) (*Room, error) {
+	defer observeQuery(ctx, "GetRoom")()
+	room, err := scanRoom(db.QueryRowContext(ctx, "SELECT "+roomColumns+" FROM rooms WHERE id = $1", roomID))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error querying room: %w", err)
+	}
+	return room, nil
+}
+
+// ListRooms returns every room, archived ones included.
+func (db *PGStore) ListRooms(ctx context.Context) ([]Room, error) {
+	defer observeQuery(ctx, "ListRooms")()
+	rows, err := db.QueryContext(ctx, "SELECT "+roomColumns+" FROM rooms ORDER BY id")
+	if err != nil {
+		return nil, fmt.Errorf("error listing rooms: %w", err)
+	}
+	defer rows.Close()
+
+	var rooms []Room
+	for rows.Next() {
+		room, err := scanRoom(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning room row: %w", err)
+		}
+		rooms = append(rooms, *room)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating room rows: %w", err)
+	}
+	return rooms, nil
+}
+
+func (db *PGStore) GetRooms(ctx context.Context) (map[string]int, error) {
+	defer observeQuery(ctx, "GetRooms")()
+	rows, err := db.QueryContext(ctx, `
+        SELECT r.id, COUNT(DISTINCT m.username) as user_count
+        FROM rooms r
+        LEFT JOIN messages m ON r.id = m.room_id
+        WHERE NOT r.archived
+        GROUP BY r.id
+    `)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rooms := make(map[string]int)
+	for rows.Next() {
+		var roomID string
+		var userCount int
+		if err := rows.Scan(&roomID, &userCount); err != nil {
+			return nil, err
+		}
+		rooms[roomID] = userCount
+	}
+	return rooms, rows.Err()
+}
+
+func (db *PGStore) SetRoomArchived(ctx context.Context, roomID string, archived bool) error {
+	defer observeQuery(ctx, "SetRoomArchived")()
+	_, err := db.ExecContext(ctx, "UPDATE rooms SET archived = $1 WHERE id = $2", archived, roomID)
+	if err != nil {
+		return fmt.Errorf("error archiving room: %w", err)
+	}
+	return nil
+}
+
+// SetRoomSlowMode sets the minimum number of seconds between messages from one user.
+func (db *PGStore) SetRoomSlowMode(ctx context.Context, roomID string, seconds int) error {
+	defer observeQuery(ctx, "SetRoomSlowMode")()
+	_, err := db.ExecContext(ctx, "UPDATE rooms SET slow_mode = $1 WHERE id = $2", seconds, roomID)
+	if err != nil {
+		return fmt.Errorf("error setting slow mode: %w", err)
+	}
+	return nil
+}
+
+// SetRoomRetention overrides the retention of a room. Zero uses the server-wide setting.
+func (db *PGStore) SetRoomRetention(ctx context.Context, roomID string, days, messages int) error {
+	defer observeQuery(ctx, "SetRoomRetention")()
+	_, err := db.ExecContext(ctx, "UPDATE rooms SET retain_days = $1, retain_messages = $2 WHERE id = $3", days, messages, roomID)
+	if err != nil {
+		return fmt.Errorf("error setting retention: %w", err)
+	}
+	return nil
+}
+
+// SetRoomLegalHold suspends or resumes pruning of a room's messages.
+func (db *PGStore) SetRoomLegalHold(ctx context.Context, roomID string, hold bool) error {
+	defer observeQuery(ctx, "SetRoomLegalHold")()
+	_, err := db.ExecContext(ctx, "UPDATE rooms SET legal_hold = $1 WHERE id = $2", hold, roomID)
+	if err != nil {
+		return fmt.Errorf("error setting legal hold: %w", err)
+	}
+	return nil
+}
+
+// DeleteRoom removes a room together with all of its messages.
+func (db *PGStore) DeleteRoom(ctx context.Context, roomID string) error {
+	defer observeQuery(ctx, "DeleteRoom")()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error deleting room: %w", err)
+	}
+	defer tx.Rollback()
+
+	// A hold placed since the caller looked at the room still stops the delete.
+	if _, err := tx.ExecContext(ctx, "DELETE FROM messages WHERE room_id = $1 AND EXISTS (SELECT 1 FROM rooms WHERE id = $1 AND NOT legal_hold)", roomID); err != nil {
+		return fmt.Errorf("error deleting room messages: %w", err)
+	}
+	result, err := tx.ExecContext(ctx, "DELETE FROM rooms WHERE id = $1 AND NOT legal_hold", roomID)
+	if err != nil {
+		return fmt.Errorf("error deleting room: %w", err)
+	}
+	if deleted, err := result.RowsAffected(); err != nil {
+		return fmt.Errorf("error deleting room: %w", err)
+	} else if deleted == 0 {
+		return errLegalHold
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error deleting room: %w", err)
+	}
+	return nil
+}
+
+func (db *PGStore) StoreMessage(ctx context.Context, roomID, username, content, timestamp string) error {
+	_, err := db.StoreMessages(ctx, []PendingMessage{{roomID, "message", username, content, timestamp}})
+	return err
+}
+
+// StoreMessages stores messages in one transaction and returns their row IDs.
+// Either all of them are stored or none is.
+func (db *PGStore) StoreMessages(ctx context.Context, messages []PendingMessage) ([]int64, error) {
+	defer observeQuery(ctx, "StoreMessages")()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error storing messages: %w", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, "INSERT INTO messages (room_id, type, username, content, timestamp, created_at) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id")
+	if err != nil {
+		return nil, fmt.Errorf("error storing messages: %w", err)
+	}
+	defer stmt.Close()
+
+	ids := make([]int64, len(messages))
+	for i, m := range messages {
+		err := stmt.QueryRowContext(ctx, m.RoomID, m.Type, m.Username, m.Content, m.Timestamp, messageTime(m.Timestamp).Unix()).Scan(&ids[i])
+		if err != nil {
+			return nil, fmt.Errorf("error storing message: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("error storing messages: %w", err)
+	}
+	return ids, nil
+}
+
+func (db *PGStore) GetRoomMessages(ctx context.Context, roomID string, limit int) ([]Message, error) {
+	defer observeQuery(ctx, "GetRoomMessages")()
+	rows, err := db.QueryContext(ctx, `
+        SELECT type, content, username, timestamp, id FROM (
+            SELECT type, content, username, timestamp, id, created_at FROM messages
+            WHERE room_id = $1
+            ORDER BY created_at DESC NULLS LAST, id DESC
+            LIMIT NULLIF($2, 0)
+        ) AS recent ORDER BY created_at NULLS FIRST, id`, roomID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching room messages: %w", err)
+	}
+	defer rows.Close()
+
+	var messages []Message
+	for rows.Next() {
+		var msg Message
+		err := rows.Scan(&msg.Type, &msg.Content, &msg.User, &msg.Timestamp, &msg.RowId)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning message row: %w", err)
+		}
+		messages = append(messages, msg)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating message rows: %w", err)
+	}
+
+	return messages, nil
+}
+
+// SearchMessages returns the messages matching a search, newest first.
+func (db *PGStore) SearchMessages(ctx context.Context, q SearchQuery) ([]SearchResult, error) {
+	defer observeQuery(ctx, "SearchMessages")()
+	var where []string
+	var args []any
+	arg := func(value any) string {
+		args = append(args, value)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	if strings.TrimSpace(q.Text) != "" {
+		where = append(where, "m.search @@ plainto_tsquery('simple', "+arg(q.Text)+")")
+	}
+	if q.RoomID != "" {
+		where = append(where, "m.room_id = "+arg(q.RoomID))
+	}
+	if q.Username != "" {
+		where = append(where, "m.username = "+arg(q.Username))
+	}
+	if !q.From.IsZero() {
+		where = append(where, "m.created_at >= "+arg(q.From.Unix()))
+	}
+	if !q.To.IsZero() {
+		where = append(where, "m.created_at < "+arg(q.To.Unix()))
+	}
+	if len(where) == 0 {
+		return nil, nil
+	}
+	// Join and leave events are stored with the messages but aren't searchable.
+	where = append(where, "m.type = 'message'")
+
+	// Every room is public, so any message still attached to a room is
+	// visible; messages of deleted rooms are gone with them.
+	rows, err := db.QueryContext(ctx, `
+        SELECT m.room_id, m.content, m.username, m.timestamp, m.id
+        FROM messages m
+        JOIN rooms r ON r.id = m.room_id
+        WHERE `+strings.Join(where, " AND ")+`
+        ORDER BY m.created_at DESC NULLS LAST, m.id DESC
+        LIMIT `+arg(q.Limit), args...)
+	if err != nil {
+		return nil, fmt.Errorf("error searching messages: %w", err)
+	}
+	defer rows.Close()
+
+	var results []SearchResult
+	for rows.Next() {
+		var result SearchResult
+		err := rows.Scan(&result.RoomID, &result.Content, &result.User, &result.Timestamp, &result.RowId)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning search result: %w", err)
+		}
+		result.Type = "message"
+		results = append(results, result)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating search results: %w", err)
+	}
+	return results, nil
+}
+
+// PruneMessages deletes up to limit of a room's oldest messages that were
+// created before the given time or fall outside the newest keep.
+func (db *PGStore) PruneMessages(ctx context.Context, roomID string, before time.Time, keep, limit int) (int, error) {
+	defer observeQuery(ctx, "PruneMessages")()
+	var where []string
+	args := []any{roomID}
+	arg := func(value any) string {
+		args = append(args, value)
+		return fmt.Sprintf("$%d", len(args))
+	}
+	if !before.IsZero() {
+		where = append(where, "created_at < "+arg(before.Unix()))
+	}
+	if keep > 0 {
+		// The newest message that doesn't fit in keep, and everything before it.
+		var cutoffTime sql.NullInt64
+		var cutoff int64
+		err := db.QueryRowContext(ctx, "SELECT created_at, id FROM messages WHERE room_id = $1 ORDER BY created_at DESC NULLS LAST, id DESC LIMIT 1 OFFSET $2", roomID, keep).Scan(&cutoffTime, &cutoff)
+		if err != nil && err != sql.ErrNoRows {
+			return 0, fmt.Errorf("error pruning messages: %w", err)
+		}
+		if err == nil && cutoffTime.Valid {
+			at := arg(cutoffTime.Int64)
+			where = append(where, "created_at IS NULL OR created_at < "+at+" OR created_at = "+at+" AND id <= "+arg(cutoff))
+		} else if err == nil {
+			// Messages without a creation time sort first.
+			where = append(where, "created_at IS NULL AND id <= "+arg(cutoff))
+		}
+	}
+	if len(where) == 0 {
+		return 0, nil
+	}
+
+	result, err := db.ExecContext(ctx, `
+        DELETE FROM messages WHERE id IN (
+            SELECT id FROM messages
+            WHERE room_id = $1 AND (`+strings.Join(where, " OR ")+`)
+                AND NOT EXISTS (SELECT 1 FROM rooms WHERE id = messages.room_id AND legal_hold)
+            ORDER BY created_at NULLS FIRST, id
+            LIMIT `+arg(limit)+`
+        )`, args...)
+	if err != nil {
+		return 0, fmt.Errorf("error pruning messages: %w", err)
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("error pruning messages: %w", err)
+	}
+	return int(deleted), nil
+}
+
+// ExportMessages calls fn for each of a room's messages created in [from, to), oldest first.
+func (db *PGStore) ExportMessages(ctx context.Context, roomID string, from, to time.Time, fn func(StoredMessage) error) error {
+	defer observeQuery(ctx, "ExportMessages")()
+	where := "room_id = $1"
+	args := []any{roomID}
+	if !from.IsZero() {
+		args = append(args, from.Unix())
+		where += " AND created_at >= $" + strconv.Itoa(len(args))
+	}
+	if !to.IsZero() {
+		args = append(args, to.Unix())
+		where += " AND created_at < $" + strconv.Itoa(len(args))
+	}
+	rows, err := db.QueryContext(ctx, "SELECT id, type, username, content, timestamp, created_at FROM messages WHERE "+where+" ORDER BY created_at NULLS FIRST, id", args...)
+	if err != nil {
+		return fmt.Errorf("error exporting messages: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		m := StoredMessage{RoomID: roomID}
+		var createdAt sql.NullInt64
+		if err := rows.Scan(&m.ID, &m.Type, &m.User, &m.Content, &m.Timestamp, &createdAt); err != nil {
+			return fmt.Errorf("error scanning message row: %w", err)
+		}
+		if createdAt.Valid {
+			m.CreatedAt = time.Unix(createdAt.Int64, 0).UTC()
+		}
+		if err := fn(m); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating message rows: %w", err)
+	}
+	return nil
+}
+
+// ImportMessages stores imported messages in one transaction, skipping those already imported.
+func (db *PGStore) ImportMessages(ctx context.Context, messages []ImportedMessage) (int, error) {
+	defer observeQuery(ctx, "ImportMessages")()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("error importing messages: %w", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, `
+        INSERT INTO messages (room_id, type, username, content, timestamp, created_at, import_key)
+        VALUES ($1, $2, $3, $4, $5, $6, $7)
+        ON CONFLICT DO NOTHING`)
+	if err != nil {
+		return 0, fmt.Errorf("error importing messages: %w", err)
+	}
+	defer stmt.Close()
+
+	imported := 0
+	for _, m := range messages {
+		result, err := stmt.ExecContext(ctx, m.RoomID, m.Type, m.Username, m.Content, m.Timestamp, m.CreatedAt.Unix(), m.Key)
+		if err != nil {
+			return 0, fmt.Errorf("error importing message: %w", err)
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return 0, fmt.Errorf("error importing message: %w", err)
+		}
+		imported += int(n)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("error importing messages: %w", err)
+	}
+	return imported, nil
+}
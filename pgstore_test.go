@@ -0,0 +1,110 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// TestMain stops the PostgreSQL server started for the tests, if any.
+func TestMain(m *testing.M) {
+	code := m.Run()
+	testPostgres.stop()
+	os.Exit(code)
+}
+
+// testPostgres is the server the PostgreSQL contract tests run against:
+// the one named by SUPCHAT_TEST_POSTGRES_DSN, or else a throwaway instance
+// started with the initdb and pg_ctl found on PATH.
+var testPostgres postgresServer
+
+type postgresServer struct {
+	once    sync.Once
+	dsn     string // Admin connection to the server
+	dir     string // Data and socket directory of a server we started
+	err     error  // Why no server is available
+	counter atomic.Int64
+}
+
+func (s *postgresServer) start() {
+	if s.dsn = os.Getenv("SUPCHAT_TEST_POSTGRES_DSN"); s.dsn != "" {
+		return
+	}
+
+	initdb, err := exec.LookPath("initdb")
+	if err != nil {
+		s.err = fmt.Errorf("set SUPCHAT_TEST_POSTGRES_DSN or put initdb and pg_ctl on PATH")
+		return
+	}
+	pgctl := filepath.Join(filepath.Dir(initdb), "pg_ctl")
+
+	if s.dir, err = os.MkdirTemp("", "supchat-postgres-"); err != nil {
+		s.err = err
+		return
+	}
+	data := filepath.Join(s.dir, "data")
+	if out, err := exec.Command(initdb, "-D", data, "-U", "postgres", "-A", "trust").CombinedOutput(); err != nil {
+		s.err = fmt.Errorf("initdb: %v: %s", err, out)
+		return
+	}
+	// Listen on a unix socket only, so the tests never clash over a port.
+	options := fmt.Sprintf("-F -k %s -c listen_addresses=''", s.dir)
+	start := exec.Command(pgctl, "-D", data, "-l", filepath.Join(s.dir, "log"), "-o", options, "-w", "start")
+	if out, err := start.CombinedOutput(); err != nil {
+		s.err = fmt.Errorf("pg_ctl start: %v: %s", err, out)
+		return
+	}
+	s.dsn = "postgres://postgres@/postgres?host=" + url.QueryEscape(s.dir)
+}
+
+func (s *postgresServer) stop() {
+	if s.dir == "" {
+		return
+	}
+	if pgctl, err := exec.LookPath("pg_ctl"); err == nil {
+		exec.Command(pgctl, "-D", filepath.Join(s.dir, "data"), "-m", "immediate", "stop").Run()
+	}
+	os.RemoveAll(s.dir)
+}
+
+// postgresTestStore returns a migrated PGStore on a fresh database that is
+// dropped when the test ends.
+func postgresTestStore(t *testing.T) Store {
+	t.Helper()
+	testPostgres.once.Do(testPostgres.start)
+	if testPostgres.err != nil {
+		t.Skip("no PostgreSQL server:", testPostgres.err)
+	}
+
+	admin, err := sql.Open("pgx", testPostgres.dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { admin.Close() })
+
+	name := fmt.Sprintf("supchat_test_%d_%d", os.Getpid(), testPostgres.counter.Add(1))
+	if _, err := admin.Exec("CREATE DATABASE " + name); err != nil {
+		t.Fatal(err)
+	}
+
+	dsn, err := url.Parse(testPostgres.dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dsn.Path = "/" + name
+	store, err := openStore(dsn.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		store.Close()
+		admin.Exec("DROP DATABASE " + name)
+	})
+	return store
+}
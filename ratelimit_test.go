@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestRateLimiterBurstAndRefill(t *testing.T) {
+	limiter := NewRateLimiter(100, 3)
+	for i := 0; i < 3; i++ {
+		if ok, _ := limiter.Allow("alice"); !ok {
+			t.Fatalf("event %d of the burst was rejected", i+1)
+		}
+	}
+	ok, wait := limiter.Allow("alice")
+	if ok || wait <= 0 || wait > 10*time.Millisecond {
+		t.Fatalf("after the burst: %v, wait %v, want a rejection with up to 10ms to wait", ok, wait)
+	}
+	if ok, _ := limiter.Allow("bob"); !ok {
+		t.Error("alice's burst used up bob's bucket")
+	}
+
+	time.Sleep(wait + 5*time.Millisecond)
+	if ok, _ := limiter.Allow("alice"); !ok {
+		t.Error("no token after waiting as told")
+	}
+	if ok, _ := limiter.Allow("alice"); ok {
+		t.Error("refilled more than the time waited")
+	}
+
+	// Refunds don't overfill the bucket.
+	limiter.Refund("bob")
+	limiter.Refund("bob")
+	limiter.Refund("bob")
+	for i := 0; i < 3; i++ {
+		limiter.Allow("bob")
+	}
+	if ok, _ := limiter.Allow("bob"); ok {
+		t.Error("refunds filled the bucket past its burst")
+	}
+
+	var off *RateLimiter
+	if ok, _ := off.Allow("alice"); !ok {
+		t.Error("nil limiter rejected an event")
+	}
+	off.Refund("alice")
+}
+
+func TestAllowSendRefundsOnRejection(t *testing.T) {
+	hub := newHub("lobby", NewMemStore(), nil)
+	hub.setSlowMode(time.Hour)
+	hub.limits = &Limits{
+		user: NewRateLimiter(0.001, 1),
+		room: NewRateLimiter(0.001, 1),
+	}
+
+	if ok, _ := hub.allowSend("alice"); !ok {
+		t.Fatal("first message rejected")
+	}
+
+	// The room is out of tokens, so bob is told to wait for the room, and
+	// keeps his slow mode slot and user token.
+	ok, wait := hub.allowSend("bob")
+	if ok || wait < 15*time.Minute || wait > 17*time.Minute {
+		t.Fatalf("bob in a full room: %v, wait %v, want the room's 1000s", ok, wait)
+	}
+	hub.limits.room = NewRateLimiter(0, 0)
+	if ok, wait := hub.allowSend("bob"); !ok {
+		t.Errorf("bob rejected once the room allowed him, wait %v", wait)
+	}
+
+	// Likewise for slow mode when the user limit rejects.
+	hub = newHub("lobby", NewMemStore(), nil)
+	hub.setSlowMode(time.Hour)
+	hub.limits = &Limits{user: NewRateLimiter(0.001, 1)}
+	hub.limits.user.Allow("carol") // Spent in another room
+	if ok, _ := hub.allowSend("carol"); ok {
+		t.Fatal("carol got past her user limit")
+	}
+	hub.limits.user = nil
+	if ok, wait := hub.allowSend("carol"); !ok {
+		t.Errorf("carol's rejected message used her slow mode slot, wait %v", wait)
+	}
+}
+
+func TestThrottledClientIsTold(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemStore()
+	store.CreateUser(ctx, "alice", "hash")
+	store.CreateSession(ctx, "token", "alice")
+	persister := NewPersister(store)
+	rm := &RoomManager{
+		Rooms:      make(map[string]*Hub),
+		db:         store,
+		persister:  persister,
+		connLimits: defaultConfig().connLimits(),
+		limits:     &Limits{user: NewRateLimiter(0.001, 1)},
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.SetPathValue("chatRoom", "lobby")
+		serveWs(rm, w, r)
+	}))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), http.Header{"Cookie": {"SessionToken=token"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	conn.WriteMessage(websocket.TextMessage, []byte("first"))
+	conn.WriteMessage(websocket.TextMessage, []byte("too soon"))
+
+	// The second message comes back to alice alone instead of going to the
+	// room. It may overtake the first, which is stored before it's broadcast.
+	var kinds []string
+	for len(kinds) < 3 {
+		var m Message
+		if err := conn.ReadJSON(&m); err != nil {
+			t.Fatal(err)
+		}
+		kinds = append(kinds, m.Type)
+		if m.Type == "throttled" && !strings.Contains(m.Content, "Try again in") {
+			t.Errorf("throttled frame %q doesn't say when to retry", m.Content)
+		}
+	}
+	sort.Strings(kinds)
+	if strings.Join(kinds, " ") != "join message throttled" {
+		t.Errorf("alice got %v", kinds)
+	}
+
+	rm.shutdown(ctx)
+	persister.Close()
+	messages, _ := store.GetRoomMessages(ctx, "lobby", 0)
+	if len(messages) != 2 || messages[1].Content != "first" {
+		t.Errorf("stored %+v, want alice's join and first message", messages)
+	}
+}
@@ -0,0 +1,231 @@
+// retention.go
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// pruneBatchSize is how many messages one delete removes. Each batch is
+	// its own short transaction, so the persister's inserts slot in between.
+	pruneBatchSize = 500
+
+	// pruneBatchPause is the breather between batches for the writer.
+	pruneBatchPause = 50 * time.Millisecond
+)
+
+// Retention limits how long messages are kept. Zero fields don't limit.
+type Retention struct {
+	Days     int // Delete messages older than this many days
+	Messages int // Keep at most this many messages per room
+}
+
+// forRoom returns the retention that applies to a room: the room's own
+// limits where it sets them, the server-wide ones otherwise.
+func (global Retention) forRoom(room Room) Retention {
+	policy := global
+	if room.RetainDays > 0 {
+		policy.Days = room.RetainDays
+	}
+	if room.RetainMessages > 0 {
+		policy.Messages = room.RetainMessages
+	}
+	return policy
+}
+
+// RetentionReport describes what one pruning pass deleted.
+type RetentionReport struct {
+	Started  time.Time
+	Finished time.Time
+	Deleted  map[string]int // Messages deleted per room, rooms with none left out
+	Held     []string       // Rooms skipped because of a legal hold
+	Total    int
+	Error    string // The error that ended the pass early, if any
+}
+
+// String summarizes the report for the log.
+func (r *RetentionReport) String() string {
+	rooms := make([]string, 0, len(r.Deleted))
+	for roomID := range r.Deleted {
+		rooms = append(rooms, roomID)
+	}
+	sort.Strings(rooms)
+	for i, roomID := range rooms {
+		rooms[i] = fmt.Sprintf("%s: %d", roomID, r.Deleted[roomID])
+	}
+
+	s := fmt.Sprintf("Retention deleted %d messages", r.Total)
+	if len(rooms) > 0 {
+		s += " (" + strings.Join(rooms, ", ") + ")"
+	}
+	if len(r.Held) > 0 {
+		s += ", skipped rooms on legal hold: " + strings.Join(r.Held, ", ")
+	}
+	return s
+}
+
+// Pruner deletes messages that fall outside the retention policies.
+type Pruner struct {
+	store  Store
+	global Retention
+	pause  time.Duration // Sleep between batches
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// NewPruner returns a pruner applying the global retention and each room's overrides.
+func NewPruner(store Store, global Retention) *Pruner {
+	return &Pruner{
+		store:  store,
+		global: global,
+		pause:  pruneBatchPause,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+}
+
+// start prunes every interval until Close.
+func (p *Pruner) start(interval time.Duration) {
+	go func() {
+		defer close(p.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			report := p.prune()
+			if report.Error != "" {
+				slog.Error("Error pruning messages", "err", report.Error)
+			}
+			if report.Total > 0 || len(report.Held) > 0 {
+				slog.Info("Pruned messages", "report", report)
+			}
+
+			select {
+			case <-ticker.C:
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Close stops a started pruner, waiting for a pass in progress to stop
+// after its current batch.
+func (p *Pruner) Close() {
+	close(p.stop)
+	<-p.done
+}
+
+// prune runs one pass over every room and records its outcome in the
+// retention metrics.
+func (p *Pruner) prune() *RetentionReport {
+	report := &RetentionReport{Started: time.Now(), Deleted: make(map[string]int)}
+	defer func() {
+		report.Finished = time.Now()
+		retentionHeldRooms.Set(float64(len(report.Held)))
+		if report.Error == "" {
+			retentionLastSuccess.SetToCurrentTime()
+		}
+	}()
+
+	ctx := context.Background()
+	rooms, err := p.store.ListRooms(ctx)
+	if err != nil {
+		report.Error = err.Error()
+		return report
+	}
+
+	for _, room := range rooms {
+		policy := p.global.forRoom(room)
+		if policy.Days == 0 && policy.Messages == 0 {
+			continue
+		}
+		if room.LegalHold {
+			report.Held = append(report.Held, room.ID)
+			continue
+		}
+
+		var before time.Time
+		if policy.Days > 0 {
+			before = report.Started.AddDate(0, 0, -policy.Days)
+		}
+		for {
+			deleted, err := p.store.PruneMessages(ctx, room.ID, before, policy.Messages, pruneBatchSize)
+			if err != nil {
+				report.Error = err.Error()
+				return report
+			}
+			if deleted > 0 {
+				report.Deleted[room.ID] += deleted
+				report.Total += deleted
+				prunedMessages.Add(float64(deleted))
+			}
+			if deleted < pruneBatchSize {
+				break
+			}
+
+			select {
+			case <-time.After(p.pause):
+			case <-p.stop:
+				return report
+			}
+		}
+	}
+	return report
+}
+
+//
+// Sets a room's retention overrides
+//
+func serveRetention(rm *RoomManager, w http.ResponseWriter, r *http.Request) {
+	room := authorizeRoom(rm, w, r)
+	if room == nil {
+		return
+	}
+
+	days, err := strconv.Atoi(r.FormValue("days"))
+	if err != nil || days < 0 {
+		http.Error(w, "Retention must be a whole number of days", http.StatusBadRequest)
+		return
+	}
+	messages, err := strconv.Atoi(r.FormValue("messages"))
+	if err != nil || messages < 0 {
+		http.Error(w, "Retention must be a whole number of messages", http.StatusBadRequest)
+		return
+	}
+	if err := rm.db.SetRoomRetention(r.Context(), room.ID, days, messages); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/c/"+room.ID, http.StatusSeeOther)
+}
+
+//
+// Places or lifts a legal hold on a room. Admins only.
+//
+func serveLegalHold(rm *RoomManager, w http.ResponseWriter, r *http.Request, hold bool) {
+	room := authorizeRoom(rm, w, r)
+	if room == nil {
+		return
+	}
+	if user := getUserFromSession(rm, r); user == nil || !user.IsAdmin {
+		http.Error(w, "Only an admin can change a legal hold", http.StatusForbidden)
+		return
+	}
+
+	if err := rm.db.SetRoomLegalHold(r.Context(), room.ID, hold); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	loggerFrom(r.Context()).Info("Set legal hold", "room", room.ID, "hold", hold)
+
+	http.Redirect(w, r, "/c/"+room.ID, http.StatusSeeOther)
+}
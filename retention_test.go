@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestPrunerAppliesPoliciesAndLegalHold(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemStore()
+	store.CreateUser(ctx, "alice", "hash")
+	for _, room := range []string{"lobby", "busy", "held", "forever"} {
+		store.CreateRoom(ctx, room, "alice")
+		for i := 0; i < 1200; i++ {
+			store.StoreMessage(ctx, room, "alice", fmt.Sprint(i), "Monday 3:04PM")
+		}
+	}
+	store.SetRoomRetention(ctx, "busy", 0, 10)
+	store.SetRoomLegalHold(ctx, "held", true)
+	store.SetRoomRetention(ctx, "forever", 0, 0)
+
+	pruner := NewPruner(store, Retention{Messages: 1000})
+	pruner.pause = 0
+	pruned := testutil.ToFloat64(prunedMessages)
+	report := pruner.prune()
+
+	want := map[string]int{"lobby": 200, "busy": 1190, "forever": 200}
+	for room, deleted := range want {
+		if report.Deleted[room] != deleted {
+			t.Errorf("deleted %d from %s, want %d", report.Deleted[room], room, deleted)
+		}
+	}
+	if report.Total != 1590 || len(report.Held) != 1 || report.Held[0] != "held" {
+		t.Errorf("report = %s", report)
+	}
+	if messages, _ := store.GetRoomMessages(ctx, "busy", 0); len(messages) != 10 || messages[0].Content != "1190" {
+		t.Errorf("busy kept %d messages starting at %q", len(messages), messages[0].Content)
+	}
+	if messages, _ := store.GetRoomMessages(ctx, "held", 0); len(messages) != 1200 {
+		t.Errorf("held room lost messages: %d left", len(messages))
+	}
+	if n := testutil.ToFloat64(prunedMessages) - pruned; n != 1590 {
+		t.Errorf("counted %v pruned messages, want 1590", n)
+	}
+	if n := testutil.ToFloat64(retentionHeldRooms); n != 1 {
+		t.Errorf("held rooms gauge = %v, want 1", n)
+	}
+}
+
+// holdingStore places a legal hold on a room after its first prune batch,
+// as an admin might while a pass is running.
+type holdingStore struct {
+	Store
+	room string
+}
+
+func (s *holdingStore) PruneMessages(ctx context.Context, roomID string, before time.Time, keep, limit int) (int, error) {
+	deleted, err := s.Store.PruneMessages(ctx, roomID, before, keep, limit)
+	if roomID == s.room {
+		s.Store.SetRoomLegalHold(ctx, roomID, true)
+	}
+	return deleted, err
+}
+
+func TestLegalHoldStopsPassInProgress(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemStore()
+	store.CreateUser(ctx, "alice", "hash")
+	store.CreateRoom(ctx, "lobby", "alice")
+	for i := 0; i < 1200; i++ {
+		store.StoreMessage(ctx, "lobby", "alice", fmt.Sprint(i), "Monday 3:04PM")
+	}
+
+	pruner := NewPruner(&holdingStore{Store: store, room: "lobby"}, Retention{Messages: 100})
+	pruner.pause = 0
+	report := pruner.prune()
+	if report.Deleted["lobby"] != pruneBatchSize {
+		t.Errorf("deleted %d, want only the first batch of %d", report.Deleted["lobby"], pruneBatchSize)
+	}
+	if messages, _ := store.GetRoomMessages(ctx, "lobby", 0); len(messages) != 1200-pruneBatchSize {
+		t.Errorf("kept %d messages", len(messages))
+	}
+}
@@ -0,0 +1,236 @@
+// rooms.go
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// canManageRoom reports whether a user may archive or delete a room.
+func canManageRoom(user *User, room *Room) bool {
+	return user.IsAdmin || (room.Owner != "" && room.Owner == user.Username)
+}
+
+// getHub returns the running hub for a room, creating the room and
+// starting its hub if needed. The user becomes the owner of a new room.
+//
+// The hub will not shut down for idleness until the caller reports back
+// through joined, so it must be called exactly once for every successful getHub.
+func (rm *RoomManager) getHub(ctx context.Context, roomID string, user *User) (*Hub, error) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	if hub, exists := rm.Rooms[roomID]; exists {
+		hub.joining++
+		return hub, nil
+	}
+
+	if err := rm.db.CreateRoom(ctx, roomID, user.Username); err != nil {
+		return nil, err
+	}
+	room, err := rm.db.GetRoom(ctx, roomID)
+	if err != nil {
+		return nil, err
+	}
+
+	hub := newHub(roomID, rm.db, rm.persister)
+	if room != nil {
+		hub.archived.Store(room.Archived)
+		hub.setSlowMode(time.Duration(room.SlowMode) * time.Second)
+	}
+	hub.limits = rm.limits
+	hub.idleTimeout = rm.hubIdleTimeout
+	hub.archivedRefresh = rm.archivedRefresh
+	hub.release = rm.releaseHub
+	hub.joining++
+	rm.Rooms[roomID] = hub
+	go hub.run()
+	return hub, nil
+}
+
+// joined marks the end of a join started with getHub, whether or not the
+// client was registered.
+func (rm *RoomManager) joined(hub *Hub) {
+	rm.mu.Lock()
+	hub.joining--
+	rm.mu.Unlock()
+}
+
+// releaseHub is called by an idle hub. It removes the hub from Rooms and
+// reports whether it may exit, which it may not while a client is joining.
+func (rm *RoomManager) releaseHub(hub *Hub) bool {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	if hub.joining > 0 {
+		return false
+	}
+	if rm.Rooms[hub.roomID] == hub {
+		delete(rm.Rooms, hub.roomID)
+	}
+	return true
+}
+
+// deleteRoom disconnects anyone in a room and purges it and its messages.
+// The hub is stopped and the messages it queued are written first, so that
+// none of them arrives after the room is gone.
+func (rm *RoomManager) deleteRoom(ctx context.Context, roomID string) error {
+	rm.mu.Lock()
+	hub := rm.Rooms[roomID]
+	delete(rm.Rooms, roomID)
+	rm.mu.Unlock()
+
+	// Stop the hub outside the lock; it may be busy with a client.
+	if hub != nil {
+		hub.stop(websocket.CloseGoingAway, "This room has been deleted")
+	}
+	if rm.persister != nil {
+		rm.persister.flush()
+	}
+
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	return rm.db.DeleteRoom(ctx, roomID)
+}
+
+// shutdown stops every hub with a "server restarting" close frame and waits
+// until ctx is done for the clients' write pumps to deliver it.
+func (rm *RoomManager) shutdown(ctx context.Context) {
+	rm.mu.Lock()
+	hubs := make([]*Hub, 0, len(rm.Rooms))
+	for roomID, hub := range rm.Rooms {
+		hubs = append(hubs, hub)
+		delete(rm.Rooms, roomID)
+	}
+	rm.mu.Unlock()
+
+	for _, hub := range hubs {
+		hub.stop(websocket.CloseServiceRestart, "server restarting")
+	}
+
+	flushed := make(chan struct{})
+	go func() {
+		rm.conns.Wait()
+		close(flushed)
+	}()
+	select {
+	case <-flushed:
+	case <-ctx.Done():
+		slog.Warn("Timed out waiting for clients to disconnect")
+	}
+}
+
+// authorizeRoom loads the room in the request path and checks that the
+// session user may manage it and that the post came from our own form.
+// It writes an error response and returns nil otherwise.
+func authorizeRoom(rm *RoomManager, w http.ResponseWriter, r *http.Request) *Room {
+	user := getUserFromSession(rm, r)
+	if user == nil {
+		http.Error(w, "Login required", http.StatusUnauthorized)
+		return nil
+	}
+
+	room, err := rm.db.GetRoom(r.Context(), r.PathValue("chatRoom"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil
+	}
+	if room == nil {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return nil
+	}
+	if !canManageRoom(user, room) {
+		http.Error(w, "Only the room owner or an admin can do that", http.StatusForbidden)
+		return nil
+	}
+	if !checkCSRF(w, r, user) {
+		return nil
+	}
+	return room
+}
+
+//
+// Archives or unarchives a room
+//
+func serveArchive(rm *RoomManager, w http.ResponseWriter, r *http.Request, archived bool) {
+	room := authorizeRoom(rm, w, r)
+	if room == nil {
+		return
+	}
+
+	if err := rm.setArchived(r.Context(), room.ID, archived); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/c/"+room.ID, http.StatusSeeOther)
+}
+
+//
+// Sets a room's slow mode
+//
+func serveSlowMode(rm *RoomManager, w http.ResponseWriter, r *http.Request) {
+	room := authorizeRoom(rm, w, r)
+	if room == nil {
+		return
+	}
+
+	seconds, err := strconv.Atoi(r.FormValue("seconds"))
+	if err != nil || seconds < 0 {
+		http.Error(w, "Slow mode must be a whole number of seconds", http.StatusBadRequest)
+		return
+	}
+	if err := rm.db.SetRoomSlowMode(r.Context(), room.ID, seconds); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rm.mu.Lock()
+	hub := rm.Rooms[room.ID]
+	rm.mu.Unlock()
+	if hub != nil {
+		hub.setSlowMode(time.Duration(seconds) * time.Second)
+		if seconds > 0 {
+			hub.announce(Message{Type: "slowmode", Content: fmt.Sprintf("Slow mode is on: one message every %d seconds", seconds)})
+		} else {
+			hub.announce(Message{Type: "slowmode", Content: "Slow mode is off"})
+		}
+	}
+
+	http.Redirect(w, r, "/c/"+room.ID, http.StatusSeeOther)
+}
+
+//
+// Deletes a room and all of its history
+//
+func serveDeleteRoom(rm *RoomManager, w http.ResponseWriter, r *http.Request) {
+	room := authorizeRoom(rm, w, r)
+	if room == nil {
+		return
+	}
+	if room.LegalHold {
+		http.Error(w, "This room is on legal hold", http.StatusConflict)
+		return
+	}
+
+	err := rm.deleteRoom(r.Context(), room.ID)
+	if errors.Is(err, errLegalHold) {
+		http.Error(w, "This room is on legal hold", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		loggerFrom(r.Context()).Error("Error deleting room", "room", room.ID, "err", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestRoomFormsNeedFormToken(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemStore()
+	store.CreateUser(ctx, "alice", "hash")
+	store.CreateRoom(ctx, "lobby", "alice")
+	store.CreateSession(ctx, "alice-token", "alice")
+
+	pages, err := NewPages(false, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rm := &RoomManager{
+		Rooms: make(map[string]*Hub),
+		db:    store,
+		pages: pages,
+	}
+	request := func(serve func(*RoomManager, http.ResponseWriter, *http.Request), method, path string, form url.Values) int {
+		w := adminRequest(rm, func(rm *RoomManager, w http.ResponseWriter, r *http.Request) {
+			r.SetPathValue("chatRoom", "lobby")
+			serve(rm, w, r)
+		}, method, path, "alice-token", form)
+		if method == "GET" && !strings.Contains(w.Body.String(), csrfToken("alice-token")) {
+			t.Errorf("%s doesn't carry the form token", path)
+		}
+		return w.Code
+	}
+	request(serveChat, "GET", "/c/lobby", nil)
+
+	// The owner's session alone isn't enough; the post must come from the room page.
+	if code := request(serveDeleteRoom, "POST", "/c/lobby/delete", url.Values{"csrf": {"forged"}}); code != http.StatusForbidden {
+		t.Errorf("delete with a forged form token: %d", code)
+	}
+	archive := func(r *RoomManager, w http.ResponseWriter, req *http.Request) { serveArchive(r, w, req, true) }
+	if code := request(archive, "POST", "/c/lobby/archive", url.Values{"csrf": {""}}); code != http.StatusForbidden {
+		t.Errorf("archive without a form token: %d", code)
+	}
+	if room, _ := store.GetRoom(ctx, "lobby"); room == nil || room.Archived {
+		t.Fatalf("lobby after forged posts: %+v", room)
+	}
+
+	if code := request(archive, "POST", "/c/lobby/archive", nil); code != http.StatusSeeOther {
+		t.Errorf("archive: %d", code)
+	}
+	if code := request(serveDeleteRoom, "POST", "/c/lobby/delete", nil); code != http.StatusSeeOther {
+		t.Errorf("delete: %d", code)
+	}
+	if room, _ := store.GetRoom(ctx, "lobby"); room != nil {
+		t.Errorf("lobby wasn't deleted: %+v", room)
+	}
+}
+
+// lateStore counts messages written after their room was deleted. Writes
+// are slowed down so that some are still queued when the delete comes.
+type lateStore struct {
+	Store
+	deleted atomic.Bool
+	late    atomic.Int64
+}
+
+func (s *lateStore) StoreMessages(ctx context.Context, messages []PendingMessage) ([]int64, error) {
+	time.Sleep(10 * time.Millisecond)
+	if s.deleted.Load() {
+		s.late.Add(int64(len(messages)))
+	}
+	return s.Store.StoreMessages(ctx, messages)
+}
+
+func (s *lateStore) DeleteRoom(ctx context.Context, roomID string) error {
+	err := s.Store.DeleteRoom(ctx, roomID)
+	s.deleted.Store(true)
+	return err
+}
+
+func TestDeleteRoomWritesQueuedMessagesFirst(t *testing.T) {
+	ctx := context.Background()
+	store := &lateStore{Store: NewMemStore()}
+	store.CreateUser(ctx, "alice", "hash")
+
+	persister := NewPersister(store)
+	defer persister.Close()
+	rm := &RoomManager{
+		Rooms:     make(map[string]*Hub),
+		db:        store,
+		persister: persister,
+	}
+	hub, err := rm.getHub(ctx, "lobby", &User{Username: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rm.joined(hub)
+
+	// alice keeps posting until the hub stops.
+	posted := make(chan int)
+	go func() {
+		n := 0
+		for {
+			select {
+			case <-hub.done:
+				posted <- n
+				return
+			default:
+				hub.post(Message{Type: "message", User: "alice", Content: "still here", Timestamp: formatTimestamp(time.Now())})
+				n++
+			}
+		}
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	if err := rm.deleteRoom(ctx, "lobby"); err != nil {
+		t.Fatal(err)
+	}
+	if n := <-posted; n == 0 {
+		t.Fatal("nothing was posted before the delete")
+	}
+	if late := store.late.Load(); late != 0 {
+		t.Errorf("%d messages were written after the room was deleted", late)
+	}
+	if messages, _ := store.GetRoomMessages(ctx, "lobby", 0); len(messages) != 0 {
+		t.Errorf("deleted room has %d messages", len(messages))
+	}
+}
+
+func TestIdleHubIsReplacedOnJoin(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemStore()
+	store.CreateUser(ctx, "alice", "hash")
+	persister := NewPersister(store)
+	defer persister.Close()
+	rm := &RoomManager{
+		Rooms:          make(map[string]*Hub),
+		db:             store,
+		persister:      persister,
+		hubIdleTimeout: 10 * time.Millisecond,
+	}
+	alice := &User{Username: "alice"}
+
+	// A hub stays up while a join is under way, even with no clients.
+	idle, err := rm.getHub(ctx, "lobby", alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-idle.done:
+		t.Fatal("hub exited during a join")
+	case <-time.After(50 * time.Millisecond):
+	}
+	rm.joined(idle)
+	select {
+	case <-idle.done:
+	case <-time.After(time.Second):
+		t.Fatal("idle hub did not exit")
+	}
+	if len(rm.hubs()) != 0 {
+		t.Error("idle hub is still listed")
+	}
+
+	// The next join starts a new hub for the room.
+	hub, err := rm.getHub(ctx, "lobby", alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hub.stop(websocket.CloseNormalClosure, "")
+	if hub == idle {
+		t.Fatal("join got the hub that exited")
+	}
+	client := joinTestHub(hub, "alice", 16)
+	rm.joined(hub)
+	expectMessage(t, client, "join", "alice")
+}
+
+func TestShutdownClosesClientsAndKeepsMessages(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemStore()
+	store.CreateUser(ctx, "alice", "hash")
+	store.CreateSession(ctx, "token", "alice")
+	persister := NewPersister(store)
+	rm := &RoomManager{
+		Rooms:      make(map[string]*Hub),
+		db:         store,
+		persister:  persister,
+		connLimits: defaultConfig().connLimits(),
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.SetPathValue("chatRoom", "lobby")
+		serveWs(rm, w, r)
+	}))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), http.Header{"Cookie": {"SessionToken=token"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	conn.WriteMessage(websocket.TextMessage, []byte("see you after the deploy"))
+	for {
+		var m Message
+		if err := conn.ReadJSON(&m); err != nil {
+			t.Fatal(err)
+		}
+		if m.Type == "message" {
+			break
+		}
+	}
+
+	// shutdown returns once the client has its close frame, well before the deadline.
+	shutdownCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	rm.shutdown(shutdownCtx)
+	if shutdownCtx.Err() != nil {
+		t.Error("shutdown waited for its deadline")
+	}
+	_, _, err = conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseServiceRestart) || !strings.Contains(err.Error(), "server restarting") {
+		t.Errorf("client read %v, want a server restarting close frame", err)
+	}
+
+	persister.Close()
+	if messages, _ := store.GetRoomMessages(ctx, "lobby", 0); len(messages) != 2 {
+		t.Errorf("stored %d messages, want alice's join and message", len(messages))
+	}
+}
@@ -0,0 +1,98 @@
+// search.go
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// searchLimit caps the number of results returned by one search.
+const searchLimit = 50
+
+// SearchQuery describes a message search. Empty fields don't filter.
+type SearchQuery struct {
+	Text     string    // Words that must all appear in the message
+	RoomID   string    // Only messages in this room
+	Username string    // Only messages by this user
+	From     time.Time // Only messages sent at or after this time
+	To       time.Time // Only messages sent before this time
+	Limit    int
+}
+
+// SearchResult is a message found by a search, with the room it belongs to.
+type SearchResult struct {
+	Message
+	RoomID string
+}
+
+// parseDateRange parses optional YYYY-MM-DD dates into the half-open
+// range [from, to), so that messages sent on the end date are included.
+func parseDateRange(from, to string) (start, end time.Time, err error) {
+	if from != "" {
+		if start, err = time.Parse(time.DateOnly, from); err != nil {
+			return start, end, errors.New("Invalid start date")
+		}
+	}
+	if to != "" {
+		if end, err = time.Parse(time.DateOnly, to); err != nil {
+			return start, end, errors.New("Invalid end date")
+		}
+		end = end.AddDate(0, 0, 1)
+	}
+	return start, end, nil
+}
+
+//
+// Serves message search page
+//
+func serveSearch(rm *RoomManager, w http.ResponseWriter, r *http.Request) {
+	type TemplateData struct {
+		Text     string
+		RoomID   string
+		Username string
+		From     string
+		To       string
+		LoggedIn bool
+		Searched bool
+		Error    string
+		Results  []SearchResult
+	}
+
+	data := TemplateData{
+		Text:     strings.TrimSpace(r.FormValue("q")),
+		RoomID:   strings.TrimSpace(r.FormValue("room")),
+		Username: strings.TrimSpace(r.FormValue("user")),
+		From:     r.FormValue("from"),
+		To:       r.FormValue("to"),
+		LoggedIn: getUserFromSession(rm, r) != nil,
+	}
+
+	query := SearchQuery{
+		Text:     data.Text,
+		RoomID:   data.RoomID,
+		Username: data.Username,
+		Limit:    searchLimit,
+	}
+	var err error
+	if query.From, query.To, err = parseDateRange(data.From, data.To); err != nil {
+		data.Error = err.Error()
+	}
+
+	if data.LoggedIn && data.Error == "" && (query.Text != "" || query.RoomID != "" || query.Username != "") {
+		data.Results, err = rm.db.SearchMessages(r.Context(), query)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		data.Searched = true
+	}
+
+	err = rm.pages.render(w, http.StatusOK, "search.html", data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
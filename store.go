@@ -0,0 +1,138 @@
+// store.go
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// errLegalHold is returned by DeleteRoom for a room on legal hold.
+var errLegalHold = errors.New("room is on legal hold")
+
+// Store is the persistence layer used by the hubs, the room manager and the
+// HTTP handlers. DB is the SQLite implementation, PGStore the PostgreSQL
+// one and MemStore keeps everything in memory.
+//
+// Lookups of a user, session or room that doesn't exist return nil and no error.
+type Store interface {
+	// Users
+	GetUser(ctx context.Context, username string) (*User, error)
+	CreateUser(ctx context.Context, username, hashedPassword string) error
+	SetAdmin(ctx context.Context, username string, admin bool) error
+	SetUserDisabled(ctx context.Context, username string, disabled bool) error
+	SetPassword(ctx context.Context, username, hashedPassword string) error
+	GetUserCount(ctx context.Context) (int, error)
+	ListUsers(ctx context.Context) ([]User, error)
+
+	// Sessions
+	CreateSession(ctx context.Context, token, username string) error
+	GetUserFromSession(ctx context.Context, token string) (*User, error)
+	ListSessions(ctx context.Context) ([]Session, error)
+	DeleteSession(ctx context.Context, token string) error
+	DeleteUserSessions(ctx context.Context, username string) error
+
+	// Rooms
+	CreateRoom(ctx context.Context, roomID, owner string) error
+	GetRoom(ctx context.Context, roomID string) (*Room, error)
+	GetRooms(ctx context.Context) (map[string]int, error)
+	SetRoomArchived(ctx context.Context, roomID string, archived bool) error
+	SetRoomSlowMode(ctx context.Context, roomID string, seconds int) error
+	SetRoomRetention(ctx context.Context, roomID string, days, messages int) error
+	SetRoomLegalHold(ctx context.Context, roomID string, hold bool) error
+	ListRooms(ctx context.Context) ([]Room, error)
+
+	// DeleteRoom deletes a room and its messages. The legal hold is checked
+	// as part of the delete, returning errLegalHold for a held room or one
+	// that doesn't exist.
+	DeleteRoom(ctx context.Context, roomID string) error
+
+	// Messages
+	StoreMessage(ctx context.Context, roomID, username, content, timestamp string) error
+	StoreMessages(ctx context.Context, messages []PendingMessage) ([]int64, error)
+
+	// GetRoomMessages returns a room's newest limit messages, or all of
+	// them for a limit of 0, oldest first by creation time and then id so
+	// that imported messages fall into place.
+	GetRoomMessages(ctx context.Context, roomID string, limit int) ([]Message, error)
+	SearchMessages(ctx context.Context, q SearchQuery) ([]SearchResult, error)
+
+	// PruneMessages deletes up to limit of a room's oldest messages that
+	// were created before the given time or fall outside the newest keep.
+	// A zero time or keep doesn't limit. Rooms on legal hold are left
+	// alone, checked as part of the delete so that a hold placed mid-pass
+	// stops the next batch. It returns how many were deleted.
+	PruneMessages(ctx context.Context, roomID string, before time.Time, keep, limit int) (int, error)
+
+	// ImportMessages stores messages from another chat's export with their
+	// original creation times, skipping those whose Key was imported before.
+	// It returns how many were stored.
+	ImportMessages(ctx context.Context, messages []ImportedMessage) (int, error)
+
+	// ExportMessages calls fn for each of a room's messages created in
+	// [from, to), oldest first, stopping at the first error. A zero time
+	// doesn't limit; with a range, messages without a creation time are left out.
+	ExportMessages(ctx context.Context, roomID string, from, to time.Time, fn func(StoredMessage) error) error
+
+	Close() error
+}
+
+var (
+	_ Store = (*DB)(nil)
+	_ Store = (*PGStore)(nil)
+	_ Store = (*MemStore)(nil)
+)
+
+// Migrator is implemented by stores with a versioned schema.
+type Migrator interface {
+	PendingMigrations() ([]migration, error)
+	Migrate() error
+}
+
+// Backuper is implemented by stores that can copy themselves while in use.
+type Backuper interface {
+	Backup(ctx context.Context, path string) error
+}
+
+// Pinger is implemented by stores that can check the database is reachable.
+type Pinger interface {
+	PingContext(ctx context.Context) error
+}
+
+var (
+	_ Pinger = (*DB)(nil)
+	_ Pinger = (*PGStore)(nil)
+)
+
+// memoryDSN selects MemStore instead of a database.
+const memoryDSN = ":memory:"
+
+// dialStore opens the store named by dsn without touching its schema.
+// dsn is a postgres:// URL, memoryDSN or the path of a SQLite file.
+func dialStore(dsn string) (Store, error) {
+	switch {
+	case dsn == memoryDSN:
+		return NewMemStore(), nil
+	case isPostgresDSN(dsn):
+		return OpenPGStore(dsn)
+	default:
+		return OpenDB(dsn)
+	}
+}
+
+// openStore opens the store named by dsn and brings its schema up to date.
+func openStore(dsn string) (Store, error) {
+	store, err := dialStore(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("database initialization failed: %w", err)
+	}
+	if m, ok := store.(Migrator); ok {
+		if err := m.Migrate(); err != nil {
+			store.Close()
+			return nil, fmt.Errorf("migration failed: %w", err)
+		}
+	}
+	return store, nil
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// storeFactories lists the Store implementations the contract tests run against.
+func storeFactories(t *testing.T) map[string]func(t *testing.T) Store {
+	return map[string]func(t *testing.T) Store{
+		"sqlite": func(t *testing.T) Store {
+			db, err := openStore(filepath.Join(t.TempDir(), "chat.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { db.Close() })
+			return db
+		},
+		"postgres": postgresTestStore,
+		"memory": func(t *testing.T) Store {
+			return NewMemStore()
+		},
+	}
+}
+
+func TestStoreContract(t *testing.T) {
+	for name, open := range storeFactories(t) {
+		t.Run(name, func(t *testing.T) {
+			store := open(t)
+			testStoreContract(t, store)
+		})
+	}
+}
+
+func testStoreContract(t *testing.T, store Store) {
+	ctx := context.Background()
+
+	t.Run("users", func(t *testing.T) {
+		if user, err := store.GetUser(ctx, "alice"); err != nil || user != nil {
+			t.Fatalf("GetUser of missing user = %v, %v", user, err)
+		}
+		if err := store.CreateUser(ctx, "alice", "hash"); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.CreateUser(ctx, "alice", "other"); err == nil {
+			t.Error("CreateUser allowed a duplicate username")
+		}
+		if err := store.SetAdmin(ctx, "alice", true); err != nil {
+			t.Fatal(err)
+		}
+		user, err := store.GetUser(ctx, "alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user.HashedPassword != "hash" || !user.IsAdmin {
+			t.Errorf("GetUser = %+v", user)
+		}
+		if err := store.CreateUser(ctx, "bob", "hash"); err != nil {
+			t.Fatal(err)
+		}
+		if n, err := store.GetUserCount(ctx); err != nil || n != 2 {
+			t.Errorf("GetUserCount = %d, %v", n, err)
+		}
+
+		if err := store.SetUserDisabled(ctx, "bob", true); err != nil {
+			t.Fatal(err)
+		}
+		users, err := store.ListUsers(ctx)
+		if err != nil || len(users) != 2 {
+			t.Fatalf("ListUsers = %+v, %v", users, err)
+		}
+		if users[0].Username != "alice" || users[0].Disabled || users[1].Username != "bob" || !users[1].Disabled {
+			t.Errorf("ListUsers = %+v, want alice enabled and bob disabled", users)
+		}
+		if err := store.SetUserDisabled(ctx, "bob", false); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := store.SetPassword(ctx, "bob", "new hash"); err != nil {
+			t.Fatal(err)
+		}
+		if user, err := store.GetUser(ctx, "bob"); err != nil || user.HashedPassword != "new hash" {
+			t.Errorf("GetUser after SetPassword = %+v, %v", user, err)
+		}
+	})
+
+	t.Run("sessions", func(t *testing.T) {
+		if err := store.CreateSession(ctx, "token", "alice"); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.CreateSession(ctx, "orphan", "nobody"); err == nil {
+			t.Error("CreateSession accepted an unknown user")
+		}
+		user, err := store.GetUserFromSession(ctx, "token")
+		if err != nil || user == nil || user.Username != "alice" {
+			t.Errorf("GetUserFromSession = %v, %v", user, err)
+		}
+		if user, err := store.GetUserFromSession(ctx, "missing"); err != nil || user != nil {
+			t.Errorf("GetUserFromSession of missing token = %v, %v", user, err)
+		}
+
+		for _, token := range []string{"second", "third"} {
+			if err := store.CreateSession(ctx, token, "alice"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		store.CreateSession(ctx, "bobs", "bob")
+		sessions, err := store.ListSessions(ctx)
+		if err != nil || len(sessions) != 4 {
+			t.Fatalf("ListSessions = %+v, %v", sessions, err)
+		}
+		if sessions[0].CreatedAt.IsZero() || time.Since(sessions[0].CreatedAt) > time.Minute {
+			t.Errorf("session created at %v", sessions[0].CreatedAt)
+		}
+		if err := store.DeleteSession(ctx, "second"); err != nil {
+			t.Fatal(err)
+		}
+		if user, _ := store.GetUserFromSession(ctx, "second"); user != nil {
+			t.Error("deleted session still logs in")
+		}
+		if err := store.DeleteUserSessions(ctx, "alice"); err != nil {
+			t.Fatal(err)
+		}
+		sessions, _ = store.ListSessions(ctx)
+		if len(sessions) != 1 || sessions[0].Token != "bobs" {
+			t.Errorf("sessions after logging alice out everywhere = %+v", sessions)
+		}
+	})
+
+	t.Run("rooms", func(t *testing.T) {
+		if err := store.CreateRoom(ctx, "lobby", "alice"); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.CreateRoom(ctx, "lobby", "bob"); err != nil {
+			t.Fatal(err)
+		}
+		room, err := store.GetRoom(ctx, "lobby")
+		if err != nil || room == nil || room.Owner != "alice" {
+			t.Fatalf("GetRoom = %+v, %v", room, err)
+		}
+		if err := store.SetRoomSlowMode(ctx, "lobby", 5); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.SetRoomArchived(ctx, "lobby", true); err != nil {
+			t.Fatal(err)
+		}
+		room, _ = store.GetRoom(ctx, "lobby")
+		if !room.Archived || room.SlowMode != 5 {
+			t.Errorf("GetRoom after updates = %+v", room)
+		}
+		rooms, err := store.GetRooms(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := rooms["lobby"]; ok {
+			t.Error("GetRooms listed an archived room")
+		}
+		store.SetRoomArchived(ctx, "lobby", false)
+		if room, err := store.GetRoom(ctx, "missing"); err != nil || room != nil {
+			t.Errorf("GetRoom of missing room = %v, %v", room, err)
+		}
+	})
+
+	t.Run("messages", func(t *testing.T) {
+		store.CreateRoom(ctx, "other", "bob")
+		for _, m := range []struct{ room, user, content string }{
+			{"lobby", "alice", "the quick brown fox"},
+			{"lobby", "bob", "a lazy dog"},
+			{"other", "bob", "brown bears"},
+		} {
+			if err := store.StoreMessage(ctx, m.room, m.user, m.content, "Monday 3:04PM"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := store.StoreMessage(ctx, "missing", "alice", "lost", "Monday 3:04PM"); err == nil {
+			t.Error("StoreMessage accepted an unknown room")
+		}
+
+		messages, err := store.GetRoomMessages(ctx, "lobby", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(messages) != 2 || messages[0].Content != "the quick brown fox" || messages[1].User != "bob" {
+			t.Fatalf("GetRoomMessages = %+v", messages)
+		}
+		if messages[0].RowId == "" || messages[0].Type != "message" {
+			t.Errorf("message missing id or type: %+v", messages[0])
+		}
+		if recent, _ := store.GetRoomMessages(ctx, "lobby", 1); len(recent) != 1 || recent[0].Content != "a lazy dog" {
+			t.Errorf("GetRoomMessages with a limit of 1 = %+v", recent)
+		}
+
+		var exported []StoredMessage
+		err = store.ExportMessages(ctx, "lobby", time.Now().Add(-time.Hour), time.Now().Add(time.Hour), func(m StoredMessage) error {
+			exported = append(exported, m)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(exported) != 2 || exported[0].ID >= exported[1].ID || exported[1].User != "bob" || exported[0].CreatedAt.IsZero() {
+			t.Errorf("ExportMessages = %+v", exported)
+		}
+
+		rooms, _ := store.GetRooms(ctx)
+		if rooms["lobby"] != 2 || rooms["other"] != 1 {
+			t.Errorf("GetRooms = %v", rooms)
+		}
+
+		search := func(q SearchQuery) []SearchResult {
+			t.Helper()
+			q.Limit = 10
+			results, err := store.SearchMessages(ctx, q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return results
+		}
+		if results := search(SearchQuery{Text: "brown"}); len(results) != 2 || results[0].RoomID != "other" {
+			t.Errorf("search brown = %+v", results)
+		}
+		if results := search(SearchQuery{Text: "brown", RoomID: "lobby"}); len(results) != 1 {
+			t.Errorf("search brown in lobby = %+v", results)
+		}
+		if results := search(SearchQuery{Username: "bob"}); len(results) != 2 {
+			t.Errorf("search by bob = %+v", results)
+		}
+		if results := search(SearchQuery{Text: "brown", To: time.Now().Add(-time.Hour)}); len(results) != 0 {
+			t.Errorf("search before an hour ago = %+v", results)
+		}
+
+		// Join and leave events aren't messages, whatever they say.
+		store.CreateRoom(ctx, "events", "bob")
+		_, err = store.StoreMessages(ctx, []PendingMessage{
+			{RoomID: "events", Type: "join", Username: "bob", Content: "has joined the chat", Timestamp: "Monday 3:05PM"},
+			{RoomID: "events", Type: "leave", Username: "bob", Content: "has left the chat", Timestamp: "Monday 3:06PM"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if results := search(SearchQuery{Username: "bob"}); len(results) != 2 {
+			t.Errorf("search by bob with his join and leave stored = %+v", results)
+		}
+		if results := search(SearchQuery{Text: "joined"}); len(results) != 0 {
+			t.Errorf("search joined = %+v", results)
+		}
+
+		// An old imported message gets the newest id but is still the oldest hit.
+		_, err = store.ImportMessages(ctx, []ImportedMessage{{
+			PendingMessage: PendingMessage{RoomID: "events", Type: "message", Username: "alice", Content: "brown owls", Timestamp: "2020-01-01T00:00:00.000Z"},
+			CreatedAt:      time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+			Key:            "test:owls",
+		}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if results := search(SearchQuery{Text: "brown"}); len(results) != 3 || results[0].RoomID != "other" || results[2].RoomID != "events" {
+			t.Errorf("search brown with an old import = %+v", results)
+		}
+	})
+
+	t.Run("retention", func(t *testing.T) {
+		store.CreateRoom(ctx, "old", "alice")
+		if err := store.SetRoomRetention(ctx, "old", 30, 2); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.SetRoomLegalHold(ctx, "old", true); err != nil {
+			t.Fatal(err)
+		}
+		store.SetRoomArchived(ctx, "old", true)
+		rooms, err := store.ListRooms(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var found *Room
+		for i := range rooms {
+			if rooms[i].ID == "old" {
+				found = &rooms[i]
+			}
+		}
+		if found == nil || found.RetainDays != 30 || found.RetainMessages != 2 || !found.LegalHold || !found.Archived {
+			t.Fatalf("ListRooms = %+v", rooms)
+		}
+
+		for i := 0; i < 5; i++ {
+			store.StoreMessage(ctx, "old", "alice", fmt.Sprint(i), "Monday 3:04PM")
+		}
+		// A legal hold keeps everything, whatever the caller asks for.
+		if n, err := store.PruneMessages(ctx, "old", time.Now(), 1, 10); err != nil || n != 0 {
+			t.Fatalf("PruneMessages on legal hold = %d, %v", n, err)
+		}
+		if err := store.SetRoomLegalHold(ctx, "old", false); err != nil {
+			t.Fatal(err)
+		}
+		// Keeping the newest two deletes three, in batches of at most two.
+		if n, err := store.PruneMessages(ctx, "old", time.Time{}, 2, 2); err != nil || n != 2 {
+			t.Fatalf("PruneMessages = %d, %v", n, err)
+		}
+		if n, _ := store.PruneMessages(ctx, "old", time.Time{}, 2, 2); n != 1 {
+			t.Fatalf("second PruneMessages deleted %d, want 1", n)
+		}
+		messages, _ := store.GetRoomMessages(ctx, "old", 0)
+		if len(messages) != 2 || messages[0].Content != "3" || messages[1].Content != "4" {
+			t.Fatalf("kept %+v", messages)
+		}
+		if n, _ := store.PruneMessages(ctx, "old", time.Time{}, 0, 10); n != 0 {
+			t.Errorf("PruneMessages without limits deleted %d", n)
+		}
+		if n, _ := store.PruneMessages(ctx, "old", time.Now().Add(time.Hour), 0, 10); n != 2 {
+			t.Errorf("PruneMessages by age deleted %d, want 2", n)
+		}
+		if messages, _ := store.GetRoomMessages(ctx, "lobby", 0); len(messages) != 2 {
+			t.Errorf("PruneMessages touched another room: %+v", messages)
+		}
+	})
+
+	t.Run("delete room", func(t *testing.T) {
+		store.SetRoomLegalHold(ctx, "lobby", true)
+		if err := store.DeleteRoom(ctx, "lobby"); !errors.Is(err, errLegalHold) {
+			t.Errorf("DeleteRoom under legal hold: %v", err)
+		}
+		if messages, _ := store.GetRoomMessages(ctx, "lobby", 0); len(messages) != 2 {
+			t.Errorf("DeleteRoom under legal hold left %d messages, want 2", len(messages))
+		}
+		store.SetRoomLegalHold(ctx, "lobby", false)
+
+		if err := store.DeleteRoom(ctx, "lobby"); err != nil {
+			t.Fatal(err)
+		}
+		if room, _ := store.GetRoom(ctx, "lobby"); room != nil {
+			t.Error("room still exists after DeleteRoom")
+		}
+		if messages, _ := store.GetRoomMessages(ctx, "lobby", 0); len(messages) != 0 {
+			t.Errorf("messages left after DeleteRoom: %+v", messages)
+		}
+		if messages, _ := store.GetRoomMessages(ctx, "other", 0); len(messages) != 1 {
+			t.Errorf("DeleteRoom touched another room: %+v", messages)
+		}
+	})
+}
@@ -0,0 +1,138 @@
+// timestamp.go
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// timestampFormat is how message times are stored and sent to clients:
+// RFC 3339 in UTC with milliseconds, so they sort as strings and browsers
+// can render them in the viewer's timezone.
+const timestampFormat = "2006-01-02T15:04:05.000Z07:00"
+
+// Layouts of the preformatted local times stored before timestampFormat.
+const (
+	legacyMessageLayout = "3:04PM"                      // After the weekday, e.g. "Monday 3:04PM"
+	legacyLeaveLayout   = "Monday, 2006-01-02 15:04:05" // Leave events
+)
+
+// formatTimestamp formats a message time for storage and the wire.
+func formatTimestamp(t time.Time) string {
+	return t.UTC().Format(timestampFormat)
+}
+
+// messageTime returns the time a message's timestamp names, or now if it
+// isn't in timestampFormat.
+func messageTime(timestamp string) time.Time {
+	if t, err := time.Parse(time.RFC3339Nano, timestamp); err == nil {
+		return t
+	}
+	return time.Now()
+}
+
+// parseLegacyTimestamp reads a timestamp stored before timestampFormat.
+// Leave events carry a full local date. Other messages only carry a
+// weekday and a clock time, so they are placed on the latest such weekday
+// at or before anchor, the time of a later message in the room. ok is
+// false if the timestamp is in neither format.
+func parseLegacyTimestamp(timestamp string, anchor time.Time, loc *time.Location) (t time.Time, ok bool) {
+	if t, err := time.ParseInLocation(legacyLeaveLayout, timestamp, loc); err == nil {
+		return t, true
+	}
+
+	day, clock, found := strings.Cut(timestamp, " ")
+	if !found {
+		return time.Time{}, false
+	}
+	weekday := -1
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		if d.String() == day {
+			weekday = int(d)
+		}
+	}
+	c, err := time.Parse(legacyMessageLayout, clock)
+	if weekday < 0 || err != nil {
+		return time.Time{}, false
+	}
+
+	anchor = anchor.In(loc)
+	t = time.Date(anchor.Year(), anchor.Month(), anchor.Day(), c.Hour(), c.Minute(), 0, 0, loc)
+	for t.After(anchor) || int(t.Weekday()) != weekday {
+		t = t.AddDate(0, 0, -1)
+	}
+	return t, true
+}
+
+// convertTimestamps rewrites a migrating database's message timestamps in
+// timestampFormat and fills in missing creation times. Rows with a
+// creation time take it as their time; older ones are parsed in the
+// server's timezone, walking each room newest first so every message is
+// dated relative to the one after it. Unreadable timestamps are left alone.
+// The statements use $n placeholders, which SQLite and PostgreSQL share.
+func convertTimestamps(tx *sql.Tx) error {
+	rows, err := tx.Query("SELECT id FROM rooms")
+	if err != nil {
+		return fmt.Errorf("error listing rooms: %w", err)
+	}
+	var rooms []string
+	for rows.Next() {
+		var roomID string
+		if err := rows.Scan(&roomID); err != nil {
+			rows.Close()
+			return err
+		}
+		rooms = append(rooms, roomID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	migrated := time.Now()
+	for _, roomID := range rooms {
+		type row struct {
+			id        int64
+			timestamp string
+			createdAt sql.NullInt64
+		}
+		var messages []row
+		rows, err := tx.Query("SELECT id, timestamp, created_at FROM messages WHERE room_id = $1 ORDER BY id DESC", roomID)
+		if err != nil {
+			return fmt.Errorf("error reading messages: %w", err)
+		}
+		for rows.Next() {
+			var r row
+			if err := rows.Scan(&r.id, &r.timestamp, &r.createdAt); err != nil {
+				rows.Close()
+				return err
+			}
+			messages = append(messages, r)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		anchor := migrated
+		for _, m := range messages {
+			var t time.Time
+			if m.createdAt.Valid {
+				t = time.Unix(m.createdAt.Int64, 0)
+			} else if parsed, ok := parseLegacyTimestamp(m.timestamp, anchor, time.Local); ok {
+				t = parsed
+			} else {
+				continue
+			}
+			_, err := tx.Exec("UPDATE messages SET timestamp = $1, created_at = $2 WHERE id = $3", formatTimestamp(t), t.Unix(), m.id)
+			if err != nil {
+				return fmt.Errorf("error converting message %d: %w", m.id, err)
+			}
+			anchor = t
+		}
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseLegacyTimestamp(t *testing.T) {
+	loc := time.FixedZone("test", -5*60*60)
+	anchor := time.Date(2024, 3, 6, 9, 0, 0, 0, loc) // A Wednesday
+
+	tests := []struct {
+		timestamp string
+		want      time.Time
+	}{
+		{"Wednesday 8:30AM", time.Date(2024, 3, 6, 8, 30, 0, 0, loc)},
+		{"Wednesday 10:15PM", time.Date(2024, 2, 28, 22, 15, 0, 0, loc)}, // Later that day than the anchor
+		{"Monday 11:59PM", time.Date(2024, 3, 4, 23, 59, 0, 0, loc)},
+		{"Thursday, 2024-01-11 16:20:05", time.Date(2024, 1, 11, 16, 20, 5, 0, loc)},
+	}
+	for _, test := range tests {
+		got, ok := parseLegacyTimestamp(test.timestamp, anchor, loc)
+		if !ok || !got.Equal(test.want) {
+			t.Errorf("parseLegacyTimestamp(%q) = %v, %t; want %v", test.timestamp, got, ok, test.want)
+		}
+	}
+	for _, timestamp := range []string{"", "Someday 3:04PM", "Monday noon"} {
+		if _, ok := parseLegacyTimestamp(timestamp, anchor, loc); ok {
+			t.Errorf("parseLegacyTimestamp(%q) succeeded", timestamp)
+		}
+	}
+}
+
+func TestMigrationConvertsTimestamps(t *testing.T) {
+	ctx := context.Background()
+	db, err := OpenDB(filepath.Join(t.TempDir(), "chat.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	before := migrationSet{migrations: migrations[:7], versionTable: sqliteSchema.versionTable}
+	if err := before.apply(db.DB); err != nil {
+		t.Fatal(err)
+	}
+
+	// The newest message has a creation time and dates the ones before it.
+	recorded := time.Date(2024, 3, 6, 12, 0, 0, 0, time.Local) // A Wednesday
+	_, err = db.Exec(`
+		INSERT INTO users (username, hashed_password) VALUES ('alice', 'hash');
+		INSERT INTO rooms (id) VALUES ('lobby');
+		INSERT INTO messages (room_id, username, content, timestamp) VALUES
+			('lobby', 'alice', 'first', 'Tuesday 11:00PM'),
+			('lobby', 'alice', 'has left the chat', 'Wednesday, 2024-03-06 08:00:00'),
+			('lobby', 'alice', 'unreadable', 'yesterday');`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("INSERT INTO messages (room_id, username, content, timestamp, created_at) VALUES ('lobby', 'alice', 'last', 'Wednesday 12:00PM', ?)", recorded.Unix())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+
+	messages, err := db.GetRoomMessages(ctx, "lobby", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		formatTimestamp(time.Date(2024, 3, 5, 23, 0, 0, 0, time.Local)),
+		formatTimestamp(time.Date(2024, 3, 6, 8, 0, 0, 0, time.Local)),
+		"yesterday",
+		formatTimestamp(recorded),
+	}
+	if len(messages) != len(want) {
+		t.Fatalf("got %d messages, want %d", len(messages), len(want))
+	}
+	for i, m := range messages {
+		if m.Timestamp != want[i] {
+			t.Errorf("message %q has timestamp %q, want %q", m.Content, m.Timestamp, want[i])
+		}
+	}
+}
@@ -0,0 +1,111 @@
+// tls.go
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// tlsMode reports how the server gets its certificate: "files", "acme",
+// or "" to serve plain HTTP.
+func (c *Config) tlsMode() string {
+	switch {
+	case c.TLSCert != "" || c.TLSKey != "":
+		return "files"
+	case len(c.ACMEDomains) > 0:
+		return "acme"
+	}
+	return ""
+}
+
+// configureTLS sets server up for the configured TLS mode. Serving with
+// TLS also enables HTTP/2. It returns the plain HTTP server to run on
+// -http-port, which redirects to HTTPS and answers ACME HTTP challenges,
+// or nil if none is configured.
+func configureTLS(c *Config, server *http.Server) (*http.Server, error) {
+	var redirect http.Handler = redirectToHTTPS(c.Port)
+
+	switch c.tlsMode() {
+	case "":
+		return nil, nil
+	case "files":
+		cert, err := tls.LoadX509KeyPair(c.TLSCert, c.TLSKey)
+		if err != nil {
+			return nil, fmt.Errorf("error loading TLS certificate: %w", err)
+		}
+		server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	case "acme":
+		m, err := newACMEManager(c)
+		if err != nil {
+			return nil, err
+		}
+		// Certificates are obtained on the first handshake for each domain,
+		// by TLS-ALPN on the HTTPS port or HTTP-01 on -http-port.
+		server.TLSConfig = m.TLSConfig()
+		redirect = m.HTTPHandler(redirect)
+	}
+
+	if c.HTTPPort == "" {
+		return nil, nil
+	}
+	return &http.Server{
+		Addr:              ":" + c.HTTPPort,
+		Handler:           redirect,
+		ReadHeaderTimeout: 10 * time.Second,
+	}, nil
+}
+
+// newACMEManager returns a manager that obtains and renews certificates
+// for the configured domains from the ACME directory, caching them in
+// -acme-cache-dir across restarts.
+func newACMEManager(c *Config) (*autocert.Manager, error) {
+	client := &acme.Client{DirectoryURL: c.ACMEDirectory}
+	if c.ACMECAFile != "" {
+		// Test servers such as Pebble use their own CA.
+		pem, err := os.ReadFile(c.ACMECAFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading ACME CA file: %w", err)
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in ACME CA file %s", c.ACMECAFile)
+		}
+		client.HTTPClient = &http.Client{
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}},
+			Timeout:   time.Minute,
+		}
+	}
+
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(c.ACMECacheDir),
+		HostPolicy: autocert.HostWhitelist(c.ACMEDomains...),
+		Email:      c.ACMEEmail,
+		Client:     client,
+	}, nil
+}
+
+// redirectToHTTPS redirects every request to the same URL over HTTPS on
+// the given port.
+func redirectToHTTPS(port string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host // No port in the request
+		}
+		if port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		target := "https://" + host + r.URL.RequestURI()
+		http.Redirect(w, r, target, http.StatusMovedPermanently)
+	})
+}
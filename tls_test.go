@@ -0,0 +1,332 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+// writeTestCertificate writes a self-signed certificate for localhost
+// and its key, returning their paths.
+func writeTestCertificate(t *testing.T) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+	return certFile, keyFile
+}
+
+func TestServeTLSWithHTTP2(t *testing.T) {
+	c := defaultConfig()
+	c.TLSCert, c.TLSKey = writeTestCertificate(t)
+	c.HTTPPort = "8080"
+
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	})}
+	redirectServer, err := configureTLS(c, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if redirectServer == nil || redirectServer.Addr != ":8080" {
+		t.Fatalf("redirect server = %+v, want one on :8080", redirectServer)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.ServeTLS(ln, "", "")
+	defer server.Close()
+
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		ForceAttemptHTTP2: true,
+	}}
+	resp, err := client.Get("https://" + ln.Addr().String() + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		t.Errorf("served over %s, want HTTP/2", resp.Proto)
+	}
+}
+
+func TestRedirectToHTTPS(t *testing.T) {
+	tests := []struct{ port, host, want string }{
+		{"443", "chat.example.com", "https://chat.example.com/c/lobby?x=1"},
+		{"443", "chat.example.com:80", "https://chat.example.com/c/lobby?x=1"},
+		{"8443", "chat.example.com:8080", "https://chat.example.com:8443/c/lobby?x=1"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "http://"+test.host+"/c/lobby?x=1", nil)
+		w := httptest.NewRecorder()
+		redirectToHTTPS(test.port).ServeHTTP(w, r)
+		if w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != test.want {
+			t.Errorf("port %s, host %s: %d to %q, want %q", test.port, test.host, w.Code, w.Header().Get("Location"), test.want)
+		}
+	}
+}
+
+func TestConfigValidatesTLS(t *testing.T) {
+	for _, args := range [][]string{
+		{"-tls-cert", "cert.pem"},
+		{"-tls-cert", "cert.pem", "-tls-key", "key.pem", "-acme-domains", "chat.example.com"},
+		{"-http-port", "80"},
+		{"-acme-domains", "chat.example.com", "-http-port", "8000"},
+	} {
+		if _, err := parseConfig(args...); err == nil {
+			t.Errorf("%v was accepted", args)
+		}
+	}
+	c, err := parseConfig("-acme-domains", "chat.example.com", "-port", "443", "-http-port", "80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.tlsMode() != "acme" {
+		t.Errorf("tlsMode = %q, want acme", c.tlsMode())
+	}
+}
+
+// acmeStub is a minimal ACME server issuing certificates from its own CA.
+// It offers only the TLS-ALPN-01 challenge and validates it by handshaking
+// with target, the server under test. Requests aren't authenticated.
+type acmeStub struct {
+	*httptest.Server
+	ca     *x509.Certificate
+	caKey  *ecdsa.PrivateKey
+	target string // Address of the server under test
+
+	mu        sync.Mutex
+	domain    string
+	validated bool
+	cert      []byte // DER of the issued certificate
+}
+
+func newACMEStub(t *testing.T) *acmeStub {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ACME stub CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &acmeStub{caKey: key}
+	if s.ca, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+	s.Server = httptest.NewTLSServer(http.HandlerFunc(s.serve))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// caFile writes the CA of the stub's own HTTPS certificate, for acme-ca-file.
+func (s *acmeStub) caFile(t *testing.T) string {
+	path := filepath.Join(t.TempDir(), "acme-ca.pem")
+	os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.Certificate().Raw}), 0o644)
+	return path
+}
+
+func (s *acmeStub) serve(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Replay-Nonce", strconv.FormatInt(time.Now().UnixNano(), 36))
+	var payload struct {
+		Identifiers []struct{ Value string } `json:"identifiers"`
+		CSR         string                   `json:"csr"`
+	}
+	if r.Method == "POST" {
+		var jws struct{ Payload string }
+		json.NewDecoder(r.Body).Decode(&jws)
+		body, _ := base64.RawURLEncoding.DecodeString(jws.Payload)
+		json.Unmarshal(body, &payload)
+	}
+	reply := func(status int, location string, v any) {
+		if location != "" {
+			w.Header().Set("Location", s.URL+location)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(v)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	order := func() map[string]any {
+		o := map[string]any{
+			"status":         "pending",
+			"identifiers":    []map[string]string{{"type": "dns", "value": s.domain}},
+			"authorizations": []string{s.URL + "/authz"},
+			"finalize":       s.URL + "/finalize",
+		}
+		if s.validated {
+			o["status"] = "ready"
+		}
+		if s.cert != nil {
+			o["status"], o["certificate"] = "valid", s.URL+"/cert"
+		}
+		return o
+	}
+	challenge := func() map[string]any {
+		status := "pending"
+		if s.validated {
+			status = "valid"
+		}
+		return map[string]any{"type": "tls-alpn-01", "url": s.URL + "/challenge", "token": "stub-token", "status": status}
+	}
+
+	switch r.URL.Path {
+	case "/directory":
+		reply(http.StatusOK, "", map[string]string{
+			"newNonce":   s.URL + "/nonce",
+			"newAccount": s.URL + "/account",
+			"newOrder":   s.URL + "/new-order",
+		})
+	case "/nonce":
+		w.WriteHeader(http.StatusOK)
+	case "/account":
+		reply(http.StatusCreated, "/account/1", map[string]string{"status": "valid"})
+	case "/new-order":
+		s.domain = payload.Identifiers[0].Value
+		reply(http.StatusCreated, "/order", order())
+	case "/order":
+		reply(http.StatusOK, "/order", order())
+	case "/authz":
+		status := "pending"
+		if s.validated {
+			status = "valid"
+		}
+		reply(http.StatusOK, "", map[string]any{
+			"status":     status,
+			"identifier": map[string]string{"type": "dns", "value": s.domain},
+			"challenges": []map[string]any{challenge()},
+		})
+	case "/challenge":
+		// The server must answer the ALPN challenge for the domain.
+		conn, err := tls.Dial("tcp", s.target, &tls.Config{ServerName: s.domain, NextProtos: []string{acme.ALPNProto}, InsecureSkipVerify: true})
+		if err != nil {
+			reply(http.StatusBadRequest, "", map[string]string{"type": "urn:ietf:params:acme:error:connection", "detail": err.Error()})
+			return
+		}
+		state := conn.ConnectionState()
+		conn.Close()
+		s.validated = state.NegotiatedProtocol == acme.ALPNProto && state.PeerCertificates[0].DNSNames[0] == s.domain
+		reply(http.StatusOK, "", challenge())
+	case "/finalize":
+		der, _ := base64.RawURLEncoding.DecodeString(payload.CSR)
+		csr, err := x509.ParseCertificateRequest(der)
+		if err != nil || !s.validated {
+			reply(http.StatusForbidden, "", map[string]string{"type": "urn:ietf:params:acme:error:unauthorized", "detail": "not authorized"})
+			return
+		}
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(2),
+			DNSNames:     csr.DNSNames,
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(24 * time.Hour),
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}
+		s.cert, _ = x509.CreateCertificate(rand.Reader, template, s.ca, csr.PublicKey, s.caKey)
+		reply(http.StatusOK, "/order", order())
+	case "/cert":
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: s.cert})
+		pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: s.ca.Raw})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestServeTLSWithACME(t *testing.T) {
+	stub := newACMEStub(t)
+	c, err := parseConfig("-acme-domains", "chat.example.test", "-acme-directory", stub.URL+"/directory",
+		"-acme-ca-file", stub.caFile(t), "-acme-cache-dir", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	})}
+	if _, err := configureTLS(c, server); err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stub.target = ln.Addr().String()
+	go server.ServeTLS(ln, "", "")
+	defer server.Close()
+
+	// The first handshake for the domain obtains its certificate.
+	roots := x509.NewCertPool()
+	roots.AddCert(stub.ca)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{ServerName: "chat.example.test", RootCAs: roots}}}
+	resp, err := client.Get("https://" + ln.Addr().String() + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if leaf := resp.TLS.PeerCertificates[0]; leaf.Issuer.CommonName != "ACME stub CA" || leaf.DNSNames[0] != "chat.example.test" {
+		t.Errorf("served certificate for %v from %q", leaf.DNSNames, leaf.Issuer.CommonName)
+	}
+	if cached, _ := os.ReadDir(c.ACMECacheDir); len(cached) == 0 {
+		t.Error("certificate wasn't cached")
+	}
+
+	// Other names are refused rather than requested.
+	client.Transport = &http.Transport{TLSClientConfig: &tls.Config{ServerName: "other.example.test", RootCAs: roots}}
+	if _, err := client.Get("https://" + ln.Addr().String() + "/"); err == nil {
+		t.Error("served a domain that isn't configured")
+	}
+}
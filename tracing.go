@@ -0,0 +1,96 @@
+// tracing.go
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Traces follow a message from the HTTP request or WebSocket frame that
+// sent it through the room's hub to the persister and the database:
+//
+//	websocket message             readPump, linked to the upgrade request
+//	└─ hub broadcast              Hub.run, until the message is fanned out
+//	   └─ persist batch           Persister, linked from every message in the batch
+//	      └─ store StoreMessages  DB or PGStore
+//
+// HTTP requests get a span from Logger, with store calls beneath it.
+
+// tracer returns the tracer for supchat's spans. It is looked up on every
+// use so that it follows the global provider, which tests replace.
+func tracer() trace.Tracer {
+	return otel.Tracer("supchat")
+}
+
+// otlpTracesPath is where OTLP/HTTP collectors receive traces.
+const otlpTracesPath = "/v1/traces"
+
+// otlpEndpoint returns the traces URL for an -otlp-endpoint, which may
+// name only the collector, like http://localhost:4318.
+func otlpEndpoint(endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("%q is not an http or https URL", endpoint)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = otlpTracesPath
+	}
+	return u.String(), nil
+}
+
+// setupTracing exports sampled spans to the configured OTLP/HTTP
+// collector and accepts trace context sent by clients. Without an
+// endpoint spans aren't recorded at all. The returned function flushes
+// spans that haven't been exported yet.
+func setupTracing(c *Config) (func(context.Context) error, error) {
+	if c.OTLPEndpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+	endpoint, err := otlpEndpoint(c.OTLPEndpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid OTLP endpoint: %w", err)
+	}
+	exporter, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(endpoint))
+	if err != nil {
+		return nil, fmt.Errorf("error creating OTLP exporter: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName("supchat"))),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(c.TraceSampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return provider.Shutdown, nil
+}
+
+// traceQuery starts a span for a store call.
+func traceQuery(ctx context.Context, method string) trace.Span {
+	_, span := tracer().Start(ctx, "store "+method, trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("db.operation.name", method)))
+	return span
+}
+
+// roomAttributes describe the room, user and connection of a span.
+func roomAttributes(roomID, username, connID string) trace.SpanStartOption {
+	return trace.WithAttributes(
+		attribute.String("supchat.room", roomID),
+		attribute.String("supchat.user", username),
+		attribute.String("supchat.conn_id", connID),
+	)
+}
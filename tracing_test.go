@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// recordSpans records every span started for the rest of the test.
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	previous, propagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		otel.SetTracerProvider(previous)
+		otel.SetTextMapPropagator(propagator)
+	})
+	return recorder
+}
+
+// endedSpan returns the ended span with the given name.
+func endedSpan(t *testing.T, recorder *tracetest.SpanRecorder, name string) sdktrace.ReadOnlySpan {
+	t.Helper()
+	for _, span := range recorder.Ended() {
+		if span.Name() == name {
+			return span
+		}
+	}
+	t.Fatalf("no %q span", name)
+	return nil
+}
+
+func TestTraceFollowsMessageToStore(t *testing.T) {
+	recorder := recordSpans(t)
+	ctx := context.Background()
+	db := openTestDB(t, filepath.Join(t.TempDir(), "chat.db"))
+	defer db.Close()
+	db.CreateUser(ctx, "alice", "hash")
+	db.CreateRoom(ctx, "lobby", "alice")
+
+	persister := NewPersister(db)
+	defer persister.Close()
+	hub := newHub("lobby", db, persister)
+	go hub.run()
+	alice := joinTestHub(hub, "alice", 16)
+	expectMessage(t, alice, "join", "alice")
+
+	frameCtx, frame := tracer().Start(ctx, "websocket message")
+	hub.broadcast <- Message{Type: "message", Content: "hi", User: "alice", Timestamp: formatTimestamp(time.Now()), ctx: frameCtx}
+	frame.End()
+	expectMessage(t, alice, "message", "alice")
+	hub.stop(websocket.CloseNormalClosure, "")
+	persister.Close()
+
+	// The hub continues the frame's trace, the batch links to the hub's
+	// span and the store call sits under the batch.
+	var broadcast sdktrace.ReadOnlySpan
+	for _, span := range recorder.Ended() {
+		if span.Name() == "hub broadcast" && span.Parent().SpanID() == frame.SpanContext().SpanID() {
+			broadcast = span
+		}
+	}
+	if broadcast == nil {
+		t.Fatal("no hub broadcast span under the frame's span")
+	}
+	var batch sdktrace.ReadOnlySpan
+	for _, span := range recorder.Ended() {
+		for _, link := range span.Links() {
+			if span.Name() == "persist batch" && link.SpanContext.SpanID() == broadcast.SpanContext().SpanID() {
+				batch = span
+			}
+		}
+	}
+	if batch == nil {
+		t.Fatal("no persist batch span linked to the hub broadcast")
+	}
+	for _, span := range recorder.Ended() {
+		if span.Name() == "store StoreMessages" && span.Parent().SpanID() == batch.SpanContext().SpanID() {
+			return
+		}
+	}
+	t.Error("no store StoreMessages span under the persist batch")
+}
+
+func TestLoggerContinuesClientTrace(t *testing.T) {
+	recorder := recordSpans(t)
+	captureLogs(t)
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /c/{chatRoom}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	r := httptest.NewRequest("GET", "/c/lobby", nil)
+	r.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	Logger(mux).ServeHTTP(httptest.NewRecorder(), r)
+
+	span := endedSpan(t, recorder, "GET /c/{chatRoom}")
+	if got := span.SpanContext().TraceID().String(); got != traceID {
+		t.Errorf("trace ID %s, want the client's %s", got, traceID)
+	}
+	if span.Status().Code != codes.Error {
+		t.Errorf("status %v, want an error for a 500", span.Status())
+	}
+}